@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+var (
+	path_proc = "/proc"
+	path_sys  = "/sys"
+
+	// Collections which have not returned are tracked by metric name, so
+	// a hung one is not started again.
+	builtins_running_lock sync.Mutex
+	builtins_running      = map[string]bool{}
+
+	// builtin_no_value means that the collector has no value yet, which is
+	// not a failure.
+	builtin_no_value = errors.New("no value yet")
+)
+
+// cpu_sample contains the CPU time counters for the cpu builtin.
+type cpu_sample struct {
+	busy, total uint64
+}
+
+var (
+	cpu_samples_lock sync.Mutex
+	// Samples are kept by metric name, so they survive reloading.
+	cpu_samples = map[string]cpu_sample{}
+)
+
+// Builtins are native collectors which are run in-process instead of a shell
+// command. They are given as commands like
+//
+//	builtin:<name>[:<argument>]
+type builtin struct {
+	collect func(m *metric, arg string) (float64, error)
+	// Some builtins require an argument like a path or an interface name.
+	has_arg bool
+}
+
+func builtin_parse(command string) (*builtin, string, error) {
+	vals := strings.SplitN(strings.TrimPrefix(command, BUILTIN_PREFIX), ":", 2)
+	name := strings.TrimSpace(vals[0])
+	b, ok := builtins[name]
+	if !ok {
+		return nil, "", fmt.Errorf("unknown builtin on this platform: %q", name)
+	}
+	arg := ""
+	if len(vals) == 2 {
+		arg = strings.TrimSpace(vals[1])
+	}
+	switch {
+	case b.has_arg && arg == "":
+		return nil, "", fmt.Errorf("builtin %s requires an argument", name)
+	case !b.has_arg && arg != "":
+		return nil, "", fmt.Errorf("builtin %s takes no argument", name)
+	}
+	return b, arg, nil
+}
+
+func metric_is_builtin(m *metric) bool {
+	return strings.HasPrefix(m.command, BUILTIN_PREFIX)
+}
+
+// exec_builtin runs the collector until ctx is done. Reading files or calling
+// statfs(2) on a hung network filesystem cannot be interrupted, so in that case
+// the collection is abandoned and left running. The metric cannot be measured
+// again before it returns.
+func exec_builtin(ctx context.Context, m *metric) (float64, error) {
+	b, arg, err := builtin_parse(m.command)
+	if err != nil {
+		return 0, err
+	}
+	builtins_running_lock.Lock()
+	if builtins_running[m.name] {
+		builtins_running_lock.Unlock()
+		return 0, errors.New("previous collection has not returned")
+	}
+	builtins_running[m.name] = true
+	builtins_running_lock.Unlock()
+
+	type result struct {
+		val float64
+		err error
+	}
+	done := make(chan result, 1)
+	go func() {
+		val, err := b.collect(m, arg)
+		builtins_running_lock.Lock()
+		delete(builtins_running, m.name)
+		builtins_running_lock.Unlock()
+		done <- result{val, err}
+	}()
+	select {
+	case r := <-done:
+		return r.val, r.err
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	}
+}
@@ -0,0 +1,213 @@
+// +build linux
+
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+var builtins = map[string]*builtin{
+	"cpu":            {collect: builtin_cpu},
+	"load1":          {collect: builtin_load(0)},
+	"load5":          {collect: builtin_load(1)},
+	"load15":         {collect: builtin_load(2)},
+	"mem_total":      {collect: builtin_meminfo("MemTotal")},
+	"mem_free":       {collect: builtin_meminfo("MemAvailable")},
+	"mem_used":       {collect: builtin_meminfo("MemTotal", "MemAvailable")},
+	"swap_total":     {collect: builtin_meminfo("SwapTotal")},
+	"swap_free":      {collect: builtin_meminfo("SwapFree")},
+	"swap_used":      {collect: builtin_meminfo("SwapTotal", "SwapFree")},
+	"fs_total":       {collect: builtin_fs(fs_total), has_arg: true},
+	"fs_free":        {collect: builtin_fs(fs_free), has_arg: true},
+	"fs_used":        {collect: builtin_fs(fs_used), has_arg: true},
+	"fs_used_pct":    {collect: builtin_fs(fs_used_pct), has_arg: true},
+	"net_rx_bytes":   {collect: builtin_net("rx_bytes"), has_arg: true},
+	"net_tx_bytes":   {collect: builtin_net("tx_bytes"), has_arg: true},
+	"net_rx_packets": {collect: builtin_net("rx_packets"), has_arg: true},
+	"net_tx_packets": {collect: builtin_net("tx_packets"), has_arg: true},
+	"net_rx_errors":  {collect: builtin_net("rx_errors"), has_arg: true},
+	"net_tx_errors":  {collect: builtin_net("tx_errors"), has_arg: true},
+}
+
+func read_cpu_sample() (cpu_sample, error) {
+	f, err := os.Open(filepath.Join(path_proc, "stat"))
+	if err != nil {
+		return cpu_sample{}, err
+	}
+	defer f.Close()
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		fields := strings.Fields(s.Text())
+		if len(fields) < 5 || fields[0] != "cpu" {
+			continue
+		}
+		// user nice system idle iowait irq softirq steal; guest time is
+		// already included in user time.
+		if len(fields) > 9 {
+			fields = fields[:9]
+		}
+		ret := cpu_sample{}
+		for n, field := range fields[1:] {
+			val, err := strconv.ParseUint(field, 10, 64)
+			if err != nil {
+				return cpu_sample{}, fmt.Errorf("bad cpu field %q: %w", field, err)
+			}
+			ret.total += val
+			// idle and iowait
+			if n != 3 && n != 4 {
+				ret.busy += val
+			}
+		}
+		return ret, nil
+	}
+	if err := s.Err(); err != nil {
+		return cpu_sample{}, err
+	}
+	return cpu_sample{}, errors.New("no cpu line in stat")
+}
+
+// builtin_cpu gives the CPU usage percentage since the previous measurement of
+// the same metric. Thus the first measurement produces no value.
+func builtin_cpu(m *metric, _ string) (float64, error) {
+	cur, err := read_cpu_sample()
+	if err != nil {
+		return 0, err
+	}
+	cpu_samples_lock.Lock()
+	defer cpu_samples_lock.Unlock()
+	prev, ok := cpu_samples[m.name]
+	if !ok {
+		cpu_samples[m.name] = cur
+		return 0, builtin_no_value
+	}
+	// The previous sample is kept until the counters advance.
+	if cur.total <= prev.total {
+		return 0, builtin_no_value
+	}
+	cpu_samples[m.name] = cur
+	if cur.busy < prev.busy {
+		return 0, errors.New("cpu counters went backwards")
+	}
+	return 100 * float64(cur.busy-prev.busy) / float64(cur.total-prev.total), nil
+}
+
+func builtin_load(field int) func(*metric, string) (float64, error) {
+	return func(_ *metric, _ string) (float64, error) {
+		b, err := os.ReadFile(filepath.Join(path_proc, "loadavg"))
+		if err != nil {
+			return 0, err
+		}
+		fields := strings.Fields(string(b))
+		if len(fields) <= field {
+			return 0, fmt.Errorf("unexpected loadavg: %q", string(b))
+		}
+		return strconv.ParseFloat(fields[field], 64)
+	}
+}
+
+func read_meminfo() (map[string]float64, error) {
+	f, err := os.Open(filepath.Join(path_proc, "meminfo"))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	ret := map[string]float64{}
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		// MemTotal:       16318412 kB
+		vals := strings.SplitN(s.Text(), ":", 2)
+		if len(vals) != 2 {
+			continue
+		}
+		fields := strings.Fields(vals[1])
+		if len(fields) == 0 {
+			continue
+		}
+		val, err := strconv.ParseFloat(fields[0], 64)
+		if err != nil {
+			continue
+		}
+		if len(fields) > 1 && fields[1] == "kB" {
+			val *= 1024
+		}
+		ret[vals[0]] = val
+	}
+	return ret, s.Err()
+}
+
+// builtin_meminfo gives the value of the first meminfo key in bytes minus the
+// values of the other keys.
+func builtin_meminfo(key string, minus ...string) func(*metric, string) (float64, error) {
+	return func(_ *metric, _ string) (float64, error) {
+		mi, err := read_meminfo()
+		if err != nil {
+			return 0, err
+		}
+		val, ok := mi[key]
+		if !ok {
+			return 0, fmt.Errorf("meminfo has no %s", key)
+		}
+		for _, k := range minus {
+			sub, ok := mi[k]
+			if !ok {
+				return 0, fmt.Errorf("meminfo has no %s", k)
+			}
+			val -= sub
+		}
+		return val, nil
+	}
+}
+
+func fs_total(st *syscall.Statfs_t) float64 {
+	return float64(st.Blocks) * float64(st.Bsize)
+}
+
+func fs_free(st *syscall.Statfs_t) float64 {
+	return float64(st.Bavail) * float64(st.Bsize)
+}
+
+func fs_used(st *syscall.Statfs_t) float64 {
+	return float64(st.Blocks-st.Bfree) * float64(st.Bsize)
+}
+
+// fs_used_pct is computed like df does it: blocks reserved for root are not
+// counted as available.
+func fs_used_pct(st *syscall.Statfs_t) float64 {
+	used := float64(st.Blocks - st.Bfree)
+	avail := float64(st.Bavail)
+	if used+avail == 0 {
+		return 0
+	}
+	return 100 * used / (used + avail)
+}
+
+func builtin_fs(f func(*syscall.Statfs_t) float64) func(*metric, string) (float64, error) {
+	return func(_ *metric, path string) (float64, error) {
+		st := syscall.Statfs_t{}
+		if err := syscall.Statfs(path, &st); err != nil {
+			return 0, fmt.Errorf("statfs %s: %w", path, err)
+		}
+		return f(&st), nil
+	}
+}
+
+func builtin_net(counter string) func(*metric, string) (float64, error) {
+	return func(_ *metric, iface string) (float64, error) {
+		if strings.ContainsAny(iface, "/") || iface == "." || iface == ".." {
+			return 0, fmt.Errorf("bad interface name: %q", iface)
+		}
+		b, err := os.ReadFile(
+			filepath.Join(path_sys, "class", "net", iface, "statistics", counter))
+		if err != nil {
+			return 0, err
+		}
+		return strconv.ParseFloat(strings.TrimSpace(string(b)), 64)
+	}
+}
@@ -0,0 +1,6 @@
+// +build !linux
+
+package main
+
+// Builtin collectors are currently only implemented for Linux.
+var builtins = map[string]*builtin{}
@@ -6,6 +6,7 @@ import (
 	"image/color"
 	"io"
 	"log"
+	"math"
 	"os"
 	"strconv"
 	"strings"
@@ -42,8 +43,34 @@ func config_load_file(filepath string) (*config, error) {
 	return c, nil
 }
 
-func config_parse_metric_options(options string) (graph_options, []error) {
+// config_parse_clamp parses bounds like <min>:<max>. Either bound may be
+// omitted.
+func config_parse_clamp(value string) (transform, error) {
+	t := transform{kind: "clamp", x: math.Inf(-1), y: math.Inf(1)}
+	split := strings.SplitN(value, ":", 2)
+	if len(split) != 2 {
+		return t, errors.New("should be like <min>:<max>")
+	}
+	for n, dst := range []*float64{&t.x, &t.y} {
+		raw := strings.TrimSpace(split[n])
+		if raw == "" {
+			continue
+		}
+		val, err := strconv.ParseFloat(raw, 64)
+		if err != nil {
+			return t, err
+		}
+		*dst = val
+	}
+	if t.x > t.y {
+		return t, errors.New("min is greater than max")
+	}
+	return t, nil
+}
+
+func config_parse_metric_options(options string) (graph_options, measure_options, []error) {
 	ret := graph_options{}
+	mret := measure_options{}
 	errs := []error{}
 	for _, option := range strings.Split(strings.TrimSpace(options), ",") {
 		split := strings.SplitN(option, "=", 2)
@@ -61,6 +88,42 @@ func config_parse_metric_options(options string) (graph_options, []error) {
 		switch key {
 		case "deriv":
 			ret.differentiate = true
+		case "counter":
+			ret.counter = true
+		case "counter_width":
+			val, err := strconv.Atoi(value)
+			if err == nil && (val < 1 || val > 64) {
+				err = errors.New("must be between 1 and 64")
+			}
+			if err != nil {
+				errs = append(errs, fmt.Errorf("bad counter_width value: %w", err))
+			}
+			ret.counter_width = val
+		case "scale", "offset":
+			val, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("bad %s value: %w", key, err))
+			}
+			ret.transforms = append(ret.transforms, transform{kind: key, x: val})
+		case "abs", "integral", "delta":
+			ret.transforms = append(ret.transforms, transform{kind: key})
+		case "clamp":
+			t, err := config_parse_clamp(value)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("bad clamp value: %w", err))
+			}
+			ret.transforms = append(ret.transforms, t)
+		case "agg":
+			if _, err := agg_parse(value); err != nil {
+				errs = append(errs, fmt.Errorf("bad agg value: %w", err))
+			}
+			ret.agg = value
+		case "rate":
+			val, ok := RATE_UNITS[value]
+			if !ok {
+				errs = append(errs, fmt.Errorf("bad rate value: %q", value))
+			}
+			ret.rate_unit = val
 		case "kibi":
 			ret.kibi = true
 		case "kilo":
@@ -79,11 +142,77 @@ func config_parse_metric_options(options string) (graph_options, []error) {
 			ret.y_max = &val
 		case "no_ds":
 			ret.no_downsample = true
+		case "period":
+			val, err := time.ParseDuration(value)
+			if err == nil && val.Seconds() < 1 {
+				err = errors.New("must be at least 1 second")
+			}
+			if err != nil {
+				errs = append(errs, fmt.Errorf("bad period value: %w", err))
+			}
+			mret.period = val
+		case "splay":
+			val, err := time.ParseDuration(value)
+			if err == nil && val < 0 {
+				err = errors.New("must not be negative")
+			}
+			if err != nil {
+				errs = append(errs, fmt.Errorf("bad splay value: %w", err))
+			}
+			mret.splay = val
+		case "timeout":
+			val, err := time.ParseDuration(value)
+			if err == nil && val <= 0 {
+				err = errors.New("must be positive")
+			}
+			if err != nil {
+				errs = append(errs, fmt.Errorf("bad timeout value: %w", err))
+			}
+			mret.timeout = val
+		case "retries":
+			val, err := strconv.Atoi(value)
+			if err == nil && val < 0 {
+				err = errors.New("must not be negative")
+			}
+			if err != nil {
+				errs = append(errs, fmt.Errorf("bad retries value: %w", err))
+			}
+			mret.retries = val
+		case "units":
+			switch value {
+			case "", UNITS_SI:
+				mret.units = UNITS_SI
+			case UNITS_IEC:
+				mret.units = UNITS_IEC
+			default:
+				errs = append(errs, fmt.Errorf("bad units value: %q", value))
+			}
+		case "argv":
+			mret.argv = true
+		case "clean_env":
+			mret.clean_env = true
+		case "duration":
+			mret.duration = true
+		case "retry_backoff":
+			val, err := time.ParseDuration(value)
+			if err == nil && val <= 0 {
+				err = errors.New("must be positive")
+			}
+			if err != nil {
+				errs = append(errs, fmt.Errorf("bad retry_backoff value: %w", err))
+			}
+			mret.retry_backoff = val
 		default:
-			errs = append(errs, fmt.Errorf("unrecognized graph option: %s", key))
+			errs = append(errs, fmt.Errorf("unrecognized option: %s", key))
 		}
 	}
-	return ret, errs
+	if ret.counter_width > 0 && !ret.counter {
+		errs = append(errs, errors.New("counter_width requires counter"))
+	}
+	if ret.rate_unit > 0 && !ret.counter && !ret.differentiate && !graph_has_integral(&ret) {
+		errs = append(errs, errors.New("rate requires deriv, counter, or integral"))
+	}
+	return ret, mret, errs
 }
 
 func config_parse_metric_line(line string) (*metric, error) {
@@ -93,10 +222,10 @@ func config_parse_metric_line(line string) (*metric, error) {
 			"line does not contain four %s-separated values, got %d",
 			CONFIG_DELIM, len(vals))
 	}
-	options, errs := config_parse_metric_options(vals[2])
+	options, moptions, errs := config_parse_metric_options(vals[2])
 	if len(errs) > 0 {
 		return nil, fmt.Errorf(
-			"%s: invalid graph options: %v", vals[0], errs)
+			"%s: invalid options: %v", vals[0], errs)
 
 	}
 
@@ -104,46 +233,295 @@ func config_parse_metric_line(line string) (*metric, error) {
 		name:        vals[0],
 		description: vals[1],
 		options:     options,
+		measure:     moptions,
 		command:     vals[3],
 	}
+	if metric_is_builtin(m) {
+		if _, _, err := builtin_parse(m.command); err != nil {
+			return nil, fmt.Errorf("%s: %w", m.name, err)
+		}
+	}
+	if metric_is_scrape(m) {
+		if _, _, err := scrape_parse(m.command); err != nil {
+			return nil, fmt.Errorf("%s: %w", m.name, err)
+		}
+	}
+	if (m.measure.argv || m.measure.clean_env) && !metric_runs_command(m) {
+		return nil, fmt.Errorf("%s: argv and clean_env are only for commands", m.name)
+	}
+	if m.measure.argv {
+		if _, err := argv_split(m.command); err != nil {
+			return nil, fmt.Errorf("%s: %w", m.name, err)
+		}
+	}
+	if m.measure.duration {
+		if metric_is_push_only(m) {
+			return nil, fmt.Errorf("%s: pushed values have no duration", m.name)
+		}
+		y_min := float64(0)
+		m.duration = &metric{
+			name:        m.name + DURATION_SUFFIX,
+			description: m.description + " (run time, s)",
+			options:     graph_options{y_min: &y_min},
+			parent:      m,
+		}
+		if !is_metric_name_valid(m.duration) {
+			return nil, fmt.Errorf("invalid duration name: %s", m.duration.name)
+		}
+	}
 
 	return m, nil
 }
 
+func config_parse_attribute_cron(m *metric, value string) error {
+	schedule, err := cron_parse(value)
+	if err != nil {
+		return err
+	}
+	if _, err := schedule.next(time.Now()); err != nil {
+		return err
+	}
+	m.measure.schedule = schedule
+	return nil
+}
+
+func config_parse_attribute_series(m *metric, value string) error {
+	vals := strings.SplitN(value, CONFIG_DELIM, 3)
+	if len(vals) < 3 {
+		return fmt.Errorf(
+			"series does not contain three %s-separated values, got %d",
+			CONFIG_DELIM, len(vals))
+	}
+	options, moptions, errs := config_parse_metric_options(vals[2])
+	if len(errs) > 0 {
+		return fmt.Errorf("invalid options: %v", errs)
+	}
+	if moptions != (measure_options{}) {
+		return errors.New("measurement options belong to the parent metric")
+	}
+	if metric_is_builtin(m) {
+		return errors.New("builtins produce only a single value")
+	}
+	if metric_is_scrape(m) {
+		return errors.New("scrapes produce only a single value")
+	}
+	if m.measure.extract != nil {
+		return errors.New("extractors produce only a single value")
+	}
+	child := &metric{
+		name:        m.name + "_" + vals[0],
+		description: vals[1],
+		options:     options,
+		parent:      m,
+		key:         vals[0],
+	}
+	if !is_metric_name_valid(child) {
+		return fmt.Errorf("invalid series name: %s", child.name)
+	}
+	m.children = append(m.children, child)
+	return nil
+}
+
+func config_parse_attribute_extract(m *metric, value string) error {
+	switch {
+	case !metric_runs_command(m):
+		return errors.New("only commands have output to extract from")
+	case len(m.children) > 0:
+		return errors.New("multi-value metrics cannot be extracted from")
+	case m.measure.extract != nil:
+		return errors.New("only one extractor is allowed")
+	}
+	e, err := extractor_parse(value)
+	if err != nil {
+		return err
+	}
+	m.measure.extract = e
+	return nil
+}
+
+// config_exec_options returns the execution options of a metric which runs a
+// command.
+func config_exec_options(m *metric) (*exec_options, error) {
+	if !metric_runs_command(m) {
+		return nil, errors.New("only commands can be given execution settings")
+	}
+	if m.measure.exec == nil {
+		m.measure.exec = &exec_options{}
+	}
+	return m.measure.exec, nil
+}
+
+func config_parse_attribute_shell(m *metric, value string) error {
+	e, err := config_exec_options(m)
+	if err != nil {
+		return err
+	}
+	if m.measure.argv {
+		return errors.New("commands run with argv have no shell")
+	}
+	if e.shell != "" {
+		return errors.New("only one shell is allowed")
+	}
+	e.shell = strings.TrimSpace(value)
+	return nil
+}
+
+func config_parse_attribute_env(m *metric, value string) error {
+	e, err := config_exec_options(m)
+	if err != nil {
+		return err
+	}
+	split := strings.SplitN(value, "=", 2)
+	if len(split) != 2 || strings.TrimSpace(split[0]) == "" {
+		return errors.New("environment variable should be like <name>=<value>")
+	}
+	e.env = append(e.env, strings.TrimSpace(split[0])+"="+split[1])
+	return nil
+}
+
+func config_parse_attribute_workdir(m *metric, value string) error {
+	e, err := config_exec_options(m)
+	if err != nil {
+		return err
+	}
+	if e.workdir != "" {
+		return errors.New("only one working directory is allowed")
+	}
+	e.workdir = strings.TrimSpace(value)
+	return nil
+}
+
+// config_parse_attribute_stdin adds a line to the input of the command.
+func config_parse_attribute_stdin(m *metric, value string) error {
+	e, err := config_exec_options(m)
+	if err != nil {
+		return err
+	}
+	stdin := value + "\n"
+	if e.stdin != nil {
+		stdin = *e.stdin + stdin
+	}
+	e.stdin = &stdin
+	return nil
+}
+
+// Metric attributes are optional per-metric settings which do not fit in the
+// options field of a metric line. They are given in the metrics section as
+//
+//	<attribute>=<metric-name>|<value>
+var metric_attributes = map[string]func(*metric, string) error{
+	"cron":    config_parse_attribute_cron,
+	"env":     config_parse_attribute_env,
+	"extract": config_parse_attribute_extract,
+	"series":  config_parse_attribute_series,
+	"shell":   config_parse_attribute_shell,
+	"stdin":   config_parse_attribute_stdin,
+	"workdir": config_parse_attribute_workdir,
+}
+
 func (c *config) parse_metrics() ([]*metric, error) {
 	metrics := []*metric{}
 	in_err := false
+	for _, pair := range c.sections["metrics"]["metric"] {
+		metric, err := config_parse_metric_line(pair.Value)
+		if err != nil {
+			log.Printf(
+				"%d: parsing metric line failed: %v\n",
+				pair.Lineno, err)
+			in_err = true
+			continue
+		}
+		metrics = append(metrics, metric)
+	}
+
+	if err := validate_metrics(metrics); err != nil {
+		log.Println("metrics validation failed: ", err)
+		return nil, err
+	}
+
+	// Attributes refer to metrics by name, so they are handled only after
+	// all metric lines are known.
 	for k, pairs := range c.sections["metrics"] {
+		if k == "metric" || k == "derived" {
+			continue
+		}
+		attribute, ok := metric_attributes[k]
+		if !ok {
+			log.Printf(
+				"%d: unrecognized item in metrics section: %s",
+				pairs[0].Lineno, k)
+			in_err = true
+			continue
+		}
 		for _, pair := range pairs {
-			switch k {
-			case "metric":
-				metric, err := config_parse_metric_line(pair.Value)
-				if err != nil {
-					log.Printf(
-						"%d: parsing metric line failed: %v\n",
-						pair.Lineno, err)
-					in_err = true
-					continue
-				}
-				metrics = append(metrics, metric)
-			default:
+			vals := strings.SplitN(pair.Value, CONFIG_DELIM, 2)
+			if len(vals) < 2 {
 				log.Printf(
-					"metrics section supports only 'metric' definitions "+
-						"but line %d has something else.", pair.Lineno)
+					"%d: %s does not contain two %s-separated values",
+					pair.Lineno, k, CONFIG_DELIM)
+				in_err = true
+				continue
+			}
+			m := metric_find(metrics, vals[0])
+			if m == nil {
+				log.Printf("%d: %s refers to unknown metric: %s",
+					pair.Lineno, k, vals[0])
+				in_err = true
+				continue
+			}
+			if err := attribute(m, vals[1]); err != nil {
+				log.Printf("%d: invalid %s for %s: %v",
+					pair.Lineno, k, m.name, err)
 				in_err = true
 			}
 		}
+	}
 
+	// Derived metrics may refer to any stored metric, so they are parsed
+	// last.
+	derived := []*metric{}
+	for _, pair := range c.sections["metrics"]["derived"] {
+		metric, err := config_parse_derived_line(pair.Value)
+		if err != nil {
+			log.Printf(
+				"%d: parsing derived line failed: %v\n",
+				pair.Lineno, err)
+			in_err = true
+			continue
+		}
+		derived = append(derived, metric)
 	}
 
-	if err := validate_metrics(metrics); err != nil {
+	if in_err {
+		return nil, errors.New("metrics section contained errors")
+	}
+
+	// Series of multi-value metrics and run times are placed right after
+	// their parent.
+	flattened := []*metric{}
+	for _, m := range metrics {
+		flattened = append(flattened, m)
+		flattened = append(flattened, m.children...)
+		if m.duration != nil {
+			flattened = append(flattened, m.duration)
+		}
+	}
+	if err := validate_metrics(derived); err != nil {
 		log.Println("metrics validation failed: ", err)
 		return nil, err
 	}
-	if in_err {
-		return nil, errors.New("metrics section contained errors")
+	for _, m := range derived {
+		if err := m.derived.resolve(flattened); err != nil {
+			log.Printf("derived metric %s: %v\n", m.name, err)
+			return nil, fmt.Errorf("%s: %w", m.name, err)
+		}
+	}
+	flattened = append(flattened, derived...)
+	if err := validate_metrics_unique(flattened); err != nil {
+		log.Println("metrics validation failed: ", err)
+		return nil, err
 	}
-	return metrics, nil
+	return flattened, nil
 }
 
 func (c *config) parse_common() (string, time.Duration, error) {
@@ -188,6 +566,12 @@ func (c *config) parse_measure() (*config_measure, error) {
 		prune_db_period: DEFAULT_PRUNE_PERIOD,
 		path_db:         DEFAULT_DB_PATH,
 		shell:           DEFAULT_SHELL,
+
+		max_concurrent_commands: DEFAULT_MAX_CONCURRENT,
+		shutdown_timeout:        DEFAULT_SHUTDOWN_TIMEOUT,
+		write_batch_size:        DEFAULT_WRITE_BATCH_SIZE,
+		write_batch_delay:       DEFAULT_WRITE_BATCH_DELAY,
+		write_queue_size:        DEFAULT_WRITE_QUEUE_SIZE,
 	}
 
 	in_err := false
@@ -211,6 +595,33 @@ func (c *config) parse_measure() (*config_measure, error) {
 				ret.prune_db_period, err = time.ParseDuration(pair.Value)
 			case "shell":
 				ret.shell = pair.Value
+			case "max_concurrent_commands":
+				ret.max_concurrent_commands, err = strconv.Atoi(pair.Value)
+				if err == nil && ret.max_concurrent_commands < 1 {
+					err = errors.New("must be greater than zero")
+				}
+			case "shutdown_timeout":
+				ret.shutdown_timeout, err = time.ParseDuration(pair.Value)
+				if err == nil && ret.shutdown_timeout < 0 {
+					err = errors.New("must not be negative")
+				}
+			case "write_batch_size":
+				ret.write_batch_size, err = strconv.Atoi(pair.Value)
+				if err == nil && ret.write_batch_size < 1 {
+					err = errors.New("must be greater than zero")
+				}
+			case "write_batch_delay":
+				ret.write_batch_delay, err = time.ParseDuration(pair.Value)
+				if err == nil && ret.write_batch_delay <= 0 {
+					err = errors.New("must be greater than zero")
+				}
+			case "push_addr":
+				ret.push_addr = pair.Value
+			case "write_queue_size":
+				ret.write_queue_size, err = strconv.Atoi(pair.Value)
+				if err == nil && ret.write_queue_size < 0 {
+					err = errors.New("must not be negative")
+				}
 			default:
 				err = fmt.Errorf(
 					"%d: unrecognized config item: %s",
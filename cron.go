@@ -0,0 +1,161 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// cron_schedule is a parsed five-field cron expression:
+//
+//	minute hour day-of-month month day-of-week
+//
+// Each field is a bitmask of permitted values.
+type cron_schedule struct {
+	minute, hour, dom, month, dow uint64
+	// If either of the day fields is restricted, cron treats a day as
+	// matching if *either* of them matches.
+	dom_any, dow_any bool
+}
+
+var cron_macros = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+func cron_parse_field(field string, min, max int) (uint64, error) {
+	ret := uint64(0)
+	for _, part := range strings.Split(field, ",") {
+		step := 1
+		if split := strings.SplitN(part, "/", 2); len(split) == 2 {
+			var err error
+			step, err = strconv.Atoi(split[1])
+			if err != nil || step < 1 {
+				return 0, fmt.Errorf("bad step: %q", split[1])
+			}
+			part = split[0]
+		}
+		lo, hi := min, max
+		switch {
+		case part == "*":
+		case strings.Contains(part, "-"):
+			split := strings.SplitN(part, "-", 2)
+			var err_lo, err_hi error
+			lo, err_lo = strconv.Atoi(split[0])
+			hi, err_hi = strconv.Atoi(split[1])
+			if err_lo != nil || err_hi != nil {
+				return 0, fmt.Errorf("bad range: %q", part)
+			}
+		default:
+			var err error
+			lo, err = strconv.Atoi(part)
+			if err != nil {
+				return 0, fmt.Errorf("bad value: %q", part)
+			}
+			hi = lo
+			// Plain `n/step` means from n until the end.
+			if step > 1 {
+				hi = max
+			}
+		}
+		if lo < min || hi > max || lo > hi {
+			return 0, fmt.Errorf("out of range [%d, %d]: %q", min, max, part)
+		}
+		for i := lo; i <= hi; i += step {
+			ret |= 1 << uint(i)
+		}
+	}
+	return ret, nil
+}
+
+func cron_parse(expr string) (*cron_schedule, error) {
+	expr = strings.TrimSpace(expr)
+	if macro, ok := cron_macros[strings.ToLower(expr)]; ok {
+		expr = macro
+	}
+	fields := strings.Fields(expr)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("wanted 5 cron fields, got %d", len(fields))
+	}
+	limits := []struct {
+		name     string
+		min, max int
+	}{
+		{"minute", 0, 59},
+		{"hour", 0, 23},
+		{"day-of-month", 1, 31},
+		{"month", 1, 12},
+		{"day-of-week", 0, 7},
+	}
+	masks := make([]uint64, 5)
+	for i, l := range limits {
+		mask, err := cron_parse_field(fields[i], l.min, l.max)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", l.name, err)
+		}
+		masks[i] = mask
+	}
+	// Both 0 and 7 mean Sunday.
+	if masks[4]&(1<<7) != 0 {
+		masks[4] |= 1
+	}
+	// Like in classic cron, fields beginning with `*`, such as `*/2`, do not
+	// restrict the day for the rule of matching either of them.
+	return &cron_schedule{
+		minute:  masks[0],
+		hour:    masks[1],
+		dom:     masks[2],
+		month:   masks[3],
+		dow:     masks[4],
+		dom_any: strings.HasPrefix(fields[2], "*"),
+		dow_any: strings.HasPrefix(fields[4], "*"),
+	}, nil
+}
+
+func (s *cron_schedule) day_matches(t time.Time) bool {
+	dom := s.dom&(1<<uint(t.Day())) != 0
+	dow := s.dow&(1<<uint(t.Weekday())) != 0
+	switch {
+	case s.dom_any && s.dow_any:
+		return true
+	case s.dom_any:
+		return dow
+	case s.dow_any:
+		return dom
+	}
+	return dom || dow
+}
+
+// next returns the first scheduled time strictly after t.
+func (s *cron_schedule) next(t time.Time) (time.Time, error) {
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	// Five years is enough to find even a leap day.
+	limit := t.AddDate(5, 0, 0)
+	for t.Before(limit) {
+		if s.month&(1<<uint(t.Month())) == 0 {
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+		if !s.day_matches(t) {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+		if s.hour&(1<<uint(t.Hour())) == 0 {
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+			continue
+		}
+		if s.minute&(1<<uint(t.Minute())) == 0 {
+			t = t.Add(time.Minute)
+			continue
+		}
+		return t, nil
+	}
+	return time.Time{}, errors.New("cron schedule never fires")
+}
@@ -17,6 +17,17 @@ func db_path_serve(filepath string) string {
 	return fmt.Sprintf("file:%s?mode=ro", filepath)
 }
 
+func db_timestamp(t time.Time) string {
+	return t.UTC().Format(TIMESTAMP_FORMAT_DB)
+}
+
+// db_timestamp_range gives the bounds for selecting rows between the times.
+// Rows inserted with CURRENT_TIMESTAMP have only second precision, so the start
+// is rounded down to the second to include them.
+func db_timestamp_range(time_start, time_end time.Time) (string, string) {
+	return db_timestamp(time_start.Truncate(time.Second)), db_timestamp(time_end)
+}
+
 func db_table_name_get(metric *metric) string {
 	if !is_metric_name_valid(metric) {
 		panic(fmt.Sprintf("invalid metric name: %#v", metric))
@@ -25,8 +36,8 @@ func db_table_name_get(metric *metric) string {
 }
 
 func n_measurements_in_bin(bins int, measure_period time.Duration, time_start, time_end time.Time) int {
-	// Note: We assume here silently that most of the data has been gathered
-	// using roughly the same measurement period.
+	// Note: We assume here silently that most of the metric's data has been
+	// gathered using roughly the same measurement period.
 	dt := time_end.Sub(time_start).Seconds()
 	binwidth := dt / float64(bins)
 	n := int(binwidth / measure_period.Seconds())
@@ -40,9 +51,7 @@ func db_datapoints_get(db *sql.DB, metric *metric, force_no_ds bool, scale, bins
 	template_select_values := `
 SELECT timestamp, value FROM %s
     WHERE
-        timestamp BETWEEN
-            DATETIME(%d, 'unixepoch')
-            AND DATETIME(%d, 'unixepoch')
+        timestamp BETWEEN ? AND ?
         %s
     ORDER BY timestamp ASC`
 
@@ -53,7 +62,8 @@ SELECT timestamp, value FROM %s
 		", metric.no_ds=", metric.options.no_downsample,
 		", scale=", scale)
 	if !force_no_ds && !metric.options.no_downsample {
-		n := n_measurements_in_bin(bins, measure_period, time_start, time_end) / scale
+		n := n_measurements_in_bin(
+			bins, metric_period(metric, measure_period), time_start, time_end) / scale
 		log.Println("scaled n=", n)
 		if n >= 2 {
 			// If we expect to find enough measurements for a single
@@ -74,11 +84,10 @@ SELECT timestamp, value FROM %s
 	q := fmt.Sprintf(
 		template_select_values,
 		db_table_name_get(metric),
-		time_start.Unix(),
-		time_end.Unix(),
 		ds)
 	log.Println("ds=", ds)
-	rows, err := db.Query(q)
+	ts_start, ts_end := db_timestamp_range(time_start, time_end)
+	rows, err := db.Query(q, ts_start, ts_end)
 	if err != nil {
 		log.Println("graph_generate: unable to select rows: ", err)
 		return nil, err
@@ -99,6 +108,51 @@ SELECT timestamp, value FROM %s
 	return dps, nil
 }
 
+// db_latest_get returns the latest value of the metric. If the metric has no
+// values, the returned timestamp is zero.
+func db_latest_get(db *sql.DB, metric *metric) (float64, time.Time, error) {
+	var ts time.Time
+	var value float64
+	err := db.QueryRow(
+		fmt.Sprintf(`SELECT value, timestamp FROM %s ORDER BY timestamp DESC LIMIT 1`,
+			db_table_name_get(metric))).Scan(&value, &ts)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, time.Time{}, nil
+	}
+	return value, ts, err
+}
+
+// db_failures_get summarizes the recorded failures of each metric between the
+// given times.
+func db_failures_get(db *sql.DB, time_start, time_end time.Time) (map[string]failure_summary, error) {
+	// With MAX(), SQLite gives the bare columns from the row which has the
+	// maximum value. Thus we get the latest failure for each metric.
+	q := fmt.Sprintf(`
+SELECT metric, COUNT(*), MAX(id), timestamp, reason, exit_code, stderr FROM %s
+    WHERE
+        timestamp BETWEEN ? AND ?
+    GROUP BY metric`, FAILURES_TABLE)
+	ts_start, ts_end := db_timestamp_range(time_start, time_end)
+	rows, err := db.Query(q, ts_start, ts_end)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	ret := map[string]failure_summary{}
+	for rows.Next() {
+		var name string
+		var max_id int64
+		fs := failure_summary{}
+		if err := rows.Scan(
+			&name, &fs.count, &max_id, &fs.ts,
+			&fs.latest.reason, &fs.latest.exit_code, &fs.latest.stderr); err != nil {
+			return nil, err
+		}
+		ret[name] = fs
+	}
+	return ret, rows.Err()
+}
+
 func db_init(db_path string) *sql.DB {
 	db, err := sql.Open("sqlite3", db_path)
 	if err != nil {
@@ -114,13 +168,22 @@ func db_init(db_path string) *sql.DB {
 	return db
 }
 
+func db_table_exists(db *sql.DB, table string) (bool, error) {
+	var n int
+	err := db.QueryRow(
+		`SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = ?`,
+		table).Scan(&n)
+	return n > 0, err
+}
+
 func db_migrate(db *sql.DB, metrics []*metric) error {
 	template_table := `
 CREATE TABLE IF NOT EXISTS %s (
     id INTEGER PRIMARY KEY,
     value DOUBLE PRECISION,
     timestamp DATETIME DEFAULT CURRENT_TIMESTAMP);
-CREATE INDEX IF NOT EXISTS index_%s ON %s (value, timestamp);`
+CREATE INDEX IF NOT EXISTS index_%s ON %s (value, timestamp);
+CREATE INDEX IF NOT EXISTS index_timestamp_%s ON %s (timestamp);`
 	in_err := false
 	for n, m := range metrics {
 		log.Printf(
@@ -128,69 +191,231 @@ CREATE INDEX IF NOT EXISTS index_%s ON %s (value, timestamp);`
 			n+1, len(metrics), m.name, m.description)
 
 		tn := db_table_name_get(m)
-		q := fmt.Sprintf(template_table, tn, tn, tn)
+		q := fmt.Sprintf(template_table, tn, tn, tn, tn, tn)
 		if _, err := db.Exec(q); err != nil {
 			log.Printf("failed to create table/index for metric %s: %v ", m.name, err)
 			in_err = true
 		}
 	}
+	template_failures := `
+CREATE TABLE IF NOT EXISTS %s (
+    id INTEGER PRIMARY KEY,
+    metric TEXT,
+    timestamp DATETIME DEFAULT CURRENT_TIMESTAMP,
+    reason TEXT,
+    exit_code INTEGER,
+    stderr TEXT);
+CREATE INDEX IF NOT EXISTS index_%s ON %s (timestamp, metric);`
+	q := fmt.Sprintf(template_failures, FAILURES_TABLE, FAILURES_TABLE, FAILURES_TABLE)
+	if _, err := db.Exec(q); err != nil {
+		log.Println("failed to create table/index for failures: ", err)
+		in_err = true
+	}
 	if in_err {
 		return errors.New("database migration encountered errors")
 	}
 	return nil
 }
 
-func db_writer(ctx context.Context, db *sql.DB, tasks <-chan db_task) {
-	template_insert := `INSERT INTO %s (value) VALUES (?)`
+// db_insert writes the measurements in a single transaction and returns how
+// many were written. Unlike db_writer, it reports errors to the caller, and
+// nothing is written if any insert fails.
+func db_insert(ctx context.Context, db *sql.DB, ms []*measurement) (int, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	// Rolling back after a commit does nothing.
+	defer tx.Rollback()
+	stmts := map[string]*sql.Stmt{}
+	for _, cur := range ms {
+		table := db_table_name_get(cur.metric)
+		stmt, ok := stmts[table]
+		if !ok {
+			stmt, err = tx.PrepareContext(
+				ctx, fmt.Sprintf(`INSERT INTO %s (value, timestamp) VALUES (?, ?)`, table))
+			if err != nil {
+				return 0, err
+			}
+			stmts[table] = stmt
+		}
+		if _, err := stmt.ExecContext(ctx, cur.value, db_timestamp(cur.ts)); err != nil {
+			return 0, fmt.Errorf("insert failed for %s with value %f: %w", cur.metric.name, cur.value, err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	return len(ms), nil
+}
+
+// db_batch collects the writes into a single transaction. Prepared
+// statements are cached per table and reused in each transaction.
+type db_batch struct {
+	db      *sql.DB
+	tx      *sql.Tx
+	stmts   map[string]*sql.Stmt
+	n       int
+	started time.Time
+}
+
+func (b *db_batch) stmt(ctx context.Context, table, template string) (*sql.Stmt, error) {
+	stmt, ok := b.stmts[table]
+	if !ok {
+		var err error
+		stmt, err = b.db.PrepareContext(ctx, fmt.Sprintf(template, table))
+		if err != nil {
+			return nil, err
+		}
+		b.stmts[table] = stmt
+	}
+	return b.tx.StmtContext(ctx, stmt), nil
+}
+
+func (b *db_batch) exec(ctx context.Context, task db_task) {
+	template_insert := `INSERT INTO %s (value, timestamp) VALUES (?, ?)`
 	template_prune := `DELETE FROM %s WHERE timestamp < DATETIME('now', '-%d seconds')`
+	template_failure := `INSERT INTO %s (metric, reason, exit_code, stderr, timestamp) VALUES (?, ?, ?, ?, ?)`
+
+	if b.tx == nil {
+		tx, err := b.db.BeginTx(ctx, nil)
+		if err != nil {
+			log.Println("db_writer: cannot begin transaction, dropping task: ", err)
+			return
+		}
+		b.tx = tx
+		b.started = time.Now()
+	}
+	b.n++
+	switch task.kind {
+	case DB_TASK_INSERT:
+		metric := task.insert_measurement.metric
+		value := task.insert_measurement.value
+		stmt, err := b.stmt(ctx, db_table_name_get(metric), template_insert)
+		if err == nil {
+			_, err = stmt.ExecContext(ctx, value, db_timestamp(task.insert_measurement.ts))
+		}
+		if err != nil {
+			log.Printf(
+				"metric insert failed for %s with value %f: %v\n",
+				metric.name, value, err)
+		}
+	case DB_TASK_PRUNE_TABLE:
+		metric := task.prune_metric
+		retention_period := task.prune_retention_period
+
+		log.Printf(
+			"Pruning metric %s for older than %s entries.\n",
+			metric.name, retention_period)
+		q := fmt.Sprintf(
+			template_prune,
+			db_table_name_get(metric),
+			int64(retention_period/time.Second))
+		t0 := time.Now()
+		_, err := b.tx.ExecContext(ctx, q)
+		if err != nil {
+			log.Println("Pruning failed: ", err)
+		} else {
+			self_prune_time.observe(time.Since(t0).Seconds())
+		}
+	case DB_TASK_FAILURE:
+		f := task.insert_failure
+		stmt, err := b.stmt(ctx, FAILURES_TABLE, template_failure)
+		if err == nil {
+			_, err = stmt.ExecContext(
+				ctx, f.metric.name, f.reason, f.exit_code, f.stderr, db_timestamp(f.ts))
+		}
+		if err != nil {
+			log.Printf(
+				"failure insert failed for %s: %v\n",
+				f.metric.name, err)
+		}
+	case DB_TASK_PRUNE_FAILURES:
+		q := fmt.Sprintf(
+			template_prune,
+			FAILURES_TABLE,
+			int64(task.prune_retention_period/time.Second))
+		_, err := b.tx.ExecContext(ctx, q)
+		if err != nil {
+			log.Println("Pruning failures failed: ", err)
+		}
+	default:
+		panic(fmt.Sprintf("This is a bug: db_task.kind == %d", task.kind))
+	}
+}
+
+// flush commits the current transaction, if any. The queue depth is the
+// amount of tasks waiting for the writer at the time of flushing.
+func (b *db_batch) flush(queue_depth, queue_size int) {
+	if b.tx == nil {
+		return
+	}
+	t0 := time.Now()
+	if err := b.tx.Commit(); err != nil {
+		log.Printf("db_writer: committing %d tasks failed: %v\n", b.n, err)
+	} else {
+		self_commit_time.observe(time.Since(t0).Seconds())
+		log.Printf(
+			"db_writer: flushed %d tasks in %s (batch age %s), queue depth %d/%d\n",
+			b.n, time.Since(t0), time.Since(b.started), queue_depth, queue_size)
+	}
+	b.tx = nil
+	b.n = 0
+}
+
+func (b *db_batch) close() {
+	for _, stmt := range b.stmts {
+		stmt.Close()
+	}
+}
+
+// db_writer writes the tasks in transactions. A transaction is committed when
+// it contains batch_size tasks or it is batch_delay old.
+func db_writer(ctx context.Context, db *sql.DB, tasks <-chan db_task,
+	batch_size int, batch_delay time.Duration) {
+
+	b := &db_batch{db: db, stmts: map[string]*sql.Stmt{}}
+	defer b.close()
+	var flush_timer <-chan time.Time
 	for {
 		select {
 		case <-ctx.Done():
+			// Cancelling the context rolls back the transaction.
 			return
-		case task := <-tasks:
-			switch task.kind {
-			case DB_TASK_INSERT:
-				metric := task.insert_measurement.metric
-				value := task.insert_measurement.value
-				_, err := db.ExecContext(
-					ctx,
-					fmt.Sprintf(template_insert, db_table_name_get(metric)),
-					value)
-				if err != nil {
-					log.Printf(
-						"metric insert failed for %s with value %f: %v\n",
-						metric.name, value, err)
-				}
-			case DB_TASK_PRUNE_TABLE:
-				metric := task.prune_metric
-				retention_period := task.prune_retention_period
-
-				log.Printf(
-					"Pruning metric %s for older than %s entries.\n",
-					metric.name, retention_period)
-				q := fmt.Sprintf(
-					template_prune,
-					db_table_name_get(metric),
-					int64(retention_period/time.Second))
-				_, err := db.ExecContext(ctx, q)
-				if err != nil {
-					log.Println("Pruning failed: ", err)
-				}
-			default:
-				panic(fmt.Sprintf("This is a bug: db_task.kind == %d", task.kind))
+		case <-flush_timer:
+			b.flush(len(tasks), cap(tasks))
+			flush_timer = nil
+		case task, ok := <-tasks:
+			// Closing the channel means that nobody will send us any
+			// more tasks and everything before it has been written.
+			if !ok {
+				b.flush(len(tasks), cap(tasks))
+				log.Println("db_writer: no more tasks, stopping")
+				return
+			}
+			b.exec(ctx, task)
+			if b.n >= batch_size {
+				b.flush(len(tasks), cap(tasks))
+			}
+			if b.tx == nil {
+				flush_timer = nil
+			} else if flush_timer == nil {
+				flush_timer = time.After(batch_delay)
 			}
 		}
 	}
 }
 
 func db_pruner(ctx context.Context, tasks chan<- db_task, metrics []*metric,
-	retention_period, prune_period time.Duration) {
+	reload <-chan []*metric, retention_period, prune_period time.Duration) {
 
 	log.Println("Entering pruning loop with period of ", prune_period)
 	for {
 		select {
 		case <-ctx.Done():
 			return
+		case metrics = <-reload:
+			log.Println("Pruning loop reloaded with", len(metrics), "metrics")
 		case <-time.After(prune_period):
 			for _, m := range metrics {
 				tasks <- db_task{
@@ -199,6 +424,10 @@ func db_pruner(ctx context.Context, tasks chan<- db_task, metrics []*metric,
 					prune_retention_period: retention_period,
 				}
 			}
+			tasks <- db_task{
+				kind:                   DB_TASK_PRUNE_FAILURES,
+				prune_retention_period: retention_period,
+			}
 		}
 	}
 }
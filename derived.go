@@ -0,0 +1,307 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Derived metrics have no table of their own. Instead, their values are
+// computed from other metrics with an arithmetic expression like
+//
+//	used / total * 100
+//
+// after each input has been binned like in its own graph.
+type expr struct {
+	// Leaves have no operator. They are either numbers or metrics.
+	op          byte
+	left, right *expr
+	value       float64
+	name        string
+	metric      *metric
+}
+
+var (
+	re_expr_number   = regexp.MustCompile(`^([0-9]+\.?[0-9]*|\.[0-9]+)([eE][+-]?[0-9]+)?$`)
+	re_expr_exponent = regexp.MustCompile(`^([0-9]+\.?[0-9]*|\.[0-9]+)[eE]$`)
+)
+
+type expr_parser struct {
+	tokens []string
+	pos    int
+}
+
+func expr_tokenize(raw string) ([]string, error) {
+	tokens := []string{}
+	for i := 0; i < len(raw); {
+		c := raw[i]
+		switch {
+		case c == ' ' || c == '\t':
+			i++
+		case strings.IndexByte("+-*/()", c) != -1:
+			tokens = append(tokens, string(c))
+			i++
+		case c == '_' || c == '.' || (c >= '0' && c <= '9') ||
+			(c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z'):
+			start := i
+			for i < len(raw) && (raw[i] == '_' || raw[i] == '.' ||
+				(raw[i] >= '0' && raw[i] <= '9') ||
+				(raw[i] >= 'a' && raw[i] <= 'z') || (raw[i] >= 'A' && raw[i] <= 'Z')) {
+				i++
+			}
+			// Exponents of numbers may have a sign, as in 1e-3.
+			if re_expr_exponent.MatchString(raw[start:i]) && i+1 < len(raw) &&
+				(raw[i] == '-' || raw[i] == '+') && raw[i+1] >= '0' && raw[i+1] <= '9' {
+				i++
+				for i < len(raw) && raw[i] >= '0' && raw[i] <= '9' {
+					i++
+				}
+			}
+			tokens = append(tokens, raw[start:i])
+		default:
+			return nil, fmt.Errorf("unexpected character %q", c)
+		}
+	}
+	return tokens, nil
+}
+
+func (p *expr_parser) peek() string {
+	if p.pos < len(p.tokens) {
+		return p.tokens[p.pos]
+	}
+	return ""
+}
+
+// parse_sum parses terms separated by + and -.
+func (p *expr_parser) parse_sum() (*expr, error) {
+	left, err := p.parse_product()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek() == "+" || p.peek() == "-" {
+		op := p.peek()[0]
+		p.pos++
+		right, err := p.parse_product()
+		if err != nil {
+			return nil, err
+		}
+		left = &expr{op: op, left: left, right: right}
+	}
+	return left, nil
+}
+
+// parse_product parses factors separated by * and /.
+func (p *expr_parser) parse_product() (*expr, error) {
+	left, err := p.parse_factor()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek() == "*" || p.peek() == "/" {
+		op := p.peek()[0]
+		p.pos++
+		right, err := p.parse_factor()
+		if err != nil {
+			return nil, err
+		}
+		left = &expr{op: op, left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *expr_parser) parse_factor() (*expr, error) {
+	token := p.peek()
+	p.pos++
+	switch token {
+	case "":
+		return nil, errors.New("unexpected end of expression")
+	case "-":
+		operand, err := p.parse_factor()
+		if err != nil {
+			return nil, err
+		}
+		return &expr{op: 'n', left: operand}, nil
+	case "(":
+		inner, err := p.parse_sum()
+		if err != nil {
+			return nil, err
+		}
+		if p.peek() != ")" {
+			return nil, errors.New("missing closing parenthesis")
+		}
+		p.pos++
+		return inner, nil
+	case "+", "*", "/", ")":
+		return nil, fmt.Errorf("unexpected %q", token)
+	}
+	// Only decimal numbers are accepted, so metrics may be called for
+	// example inf or nan.
+	if re_expr_number.MatchString(token) {
+		val, err := strconv.ParseFloat(token, 64)
+		if err != nil {
+			return nil, fmt.Errorf("bad number %q: %w", token, err)
+		}
+		return &expr{value: val}, nil
+	}
+	return &expr{name: token}, nil
+}
+
+func expr_parse(raw string) (*expr, error) {
+	tokens, err := expr_tokenize(raw)
+	if err != nil {
+		return nil, err
+	}
+	p := &expr_parser{tokens: tokens}
+	e, err := p.parse_sum()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.tokens) {
+		return nil, fmt.Errorf("unexpected %q", p.peek())
+	}
+	return e, nil
+}
+
+// resolve finds the metrics which the expression refers to. Only stored
+// metrics may be used.
+func (e *expr) resolve(metrics []*metric) error {
+	if e == nil {
+		return nil
+	}
+	if e.op == 0 && e.name != "" {
+		m := metric_find(metrics, e.name)
+		if m == nil || !metric_is_stored(m) {
+			return fmt.Errorf("unknown or unstored metric: %s", e.name)
+		}
+		e.metric = m
+		return nil
+	}
+	if err := e.left.resolve(metrics); err != nil {
+		return err
+	}
+	return e.right.resolve(metrics)
+}
+
+// inputs returns the metrics of the expression, each only once.
+func (e *expr) inputs() []*metric {
+	ret := []*metric{}
+	var walk func(*expr)
+	walk = func(e *expr) {
+		if e == nil {
+			return
+		}
+		if e.metric != nil && metric_find(ret, e.metric.name) == nil {
+			ret = append(ret, e.metric)
+		}
+		walk(e.left)
+		walk(e.right)
+	}
+	walk(e)
+	return ret
+}
+
+// eval computes the i'th value. Division by zero gives NaN so that nothing is
+// drawn instead of an infinite value.
+func (e *expr) eval(i int, inputs map[*metric][]float64) float64 {
+	switch e.op {
+	case 0:
+		if e.metric != nil {
+			return inputs[e.metric][i]
+		}
+		return e.value
+	case 'n':
+		return -e.left.eval(i, inputs)
+	}
+	left, right := e.left.eval(i, inputs), e.right.eval(i, inputs)
+	switch e.op {
+	case '+':
+		return left + right
+	case '-':
+		return left - right
+	case '*':
+		return left * right
+	case '/':
+		if right == 0 {
+			return math.NaN()
+		}
+		return left / right
+	}
+	panic(fmt.Sprintf("This is a bug: unknown operator %q", e.op))
+}
+
+// config_parse_derived_line parses a line like the metric lines, but with an
+// expression in place of the command.
+func config_parse_derived_line(line string) (*metric, error) {
+	vals := strings.SplitN(line, CONFIG_DELIM, 4)
+	if len(vals) < 4 {
+		return nil, fmt.Errorf(
+			"line does not contain four %s-separated values, got %d",
+			CONFIG_DELIM, len(vals))
+	}
+	options, moptions, errs := config_parse_metric_options(vals[2])
+	if len(errs) > 0 {
+		return nil, fmt.Errorf("%s: invalid options: %v", vals[0], errs)
+	}
+	if moptions != (measure_options{}) {
+		return nil, fmt.Errorf("%s: derived metrics are not measured", vals[0])
+	}
+	// Counters are differentiated before binning, but derived metrics are
+	// only computed from binned values.
+	if options.counter {
+		return nil, fmt.Errorf("%s: counter cannot be used with derived metrics", vals[0])
+	}
+	e, err := expr_parse(vals[3])
+	if err != nil {
+		return nil, fmt.Errorf("%s: bad expression: %w", vals[0], err)
+	}
+	return &metric{
+		name:        vals[0],
+		description: vals[1],
+		options:     options,
+		derived:     e,
+	}, nil
+}
+
+// derived_binned_get bins the inputs of the derived metric like in their own
+// graphs and computes its values. If the derived metric has an aggregation, it
+// is used for all the inputs. The metric's own operation is done to the
+// computed values.
+func derived_binned_get(db *sql.DB, derived *metric, force_no_ds bool, scale, bins int,
+	measure_period time.Duration, time_start, time_end time.Time) ([]float64, []time.Time, error) {
+
+	inputs := map[*metric][]float64{}
+	var labels []time.Time
+	for _, m := range derived.derived.inputs() {
+		input := m
+		if derived.options.agg != "" {
+			overridden := *m
+			overridden.options.agg = derived.options.agg
+			input = &overridden
+		}
+		values, cur_labels, err := metric_binned_get(
+			db, input, force_no_ds, scale, bins, measure_period, time_start, time_end)
+		if err != nil {
+			return nil, nil, fmt.Errorf("%s: %w", m.name, err)
+		}
+		inputs[m] = values
+		labels = cur_labels
+	}
+	computed := make([]float64, bins)
+	for i := range computed {
+		computed[i] = derived.derived.eval(i, inputs)
+	}
+	// Without inputs, the labels are computed from empty data.
+	if labels == nil {
+		_, labels, _, _ = bin_datapoints(nil, int64(bins), time_start, time_end, op_identity, agg_avg)
+	}
+	op := metric_bin_op(derived)
+	result := make([]float64, bins)
+	for i := range result {
+		result[i] = op(i, computed, labels)
+	}
+	return result, labels, nil
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"bufio"
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type export_options struct {
+	format             string
+	raw_start, raw_end string
+	binned             bool
+	bin_width          time.Duration
+}
+
+// export_series contains the exported values of a single metric.
+type export_series struct {
+	metric *metric
+	values []float64
+	times  []time.Time
+}
+
+// export_parse_time parses the time range bounds. Besides the push timestamps,
+// a duration means that long ago.
+func export_parse_time(raw string, now time.Time) (time.Time, error) {
+	if d, err := time.ParseDuration(raw); err == nil {
+		return now.Add(-d), nil
+	}
+	if raw == "" || raw == "now" {
+		return now, nil
+	}
+	return push_parse_ts(raw)
+}
+
+// export_series_get gets the metric's values either as they are stored or
+// binned and processed like in the graphs. All the values are used, so no
+// downsampling is done.
+func export_series_get(db *sql.DB, m *metric, time_start, time_end time.Time,
+	opts *export_options, max_bins int) (*export_series, error) {
+
+	if !opts.binned {
+		dps, err := db_datapoints_get(db, m, true, 1, 1, 0, time_start, time_end)
+		if err != nil {
+			return nil, err
+		}
+		ret := &export_series{metric: m}
+		for _, dp := range dps {
+			ret.values = append(ret.values, dp.value)
+			ret.times = append(ret.times, dp.ts)
+		}
+		return ret, nil
+	}
+	bins, err := graph_bins(time_start, time_end, opts.bin_width, max_bins)
+	if err != nil {
+		return nil, err
+	}
+	values, times, err := metric_binned_get(db, m, true, 1, bins, 0, time_start, time_end)
+	if err != nil {
+		return nil, err
+	}
+	return &export_series{metric: m, values: values, times: times}, nil
+}
+
+func export_ts(t time.Time) string {
+	return t.UTC().Format(time.RFC3339Nano)
+}
+
+func export_write_csv(w io.Writer, series []*export_series) error {
+	cw := csv.NewWriter(w)
+	if err := cw.Write([]string{"metric", "timestamp", "value"}); err != nil {
+		return err
+	}
+	for _, s := range series {
+		for i, v := range s.values {
+			if math.IsNaN(v) {
+				continue
+			}
+			rec := []string{s.metric.name, export_ts(s.times[i]), strconv.FormatFloat(v, 'g', -1, 64)}
+			if err := cw.Write(rec); err != nil {
+				return err
+			}
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// export_write_jsonl writes lines which `lilmon import` understands.
+func export_write_jsonl(w io.Writer, series []*export_series) error {
+	enc := json.NewEncoder(w)
+	for _, s := range series {
+		for i, v := range s.values {
+			if math.IsNaN(v) {
+				continue
+			}
+			line := struct {
+				Metric string  `json:"metric"`
+				Ts     string  `json:"ts"`
+				Value  float64 `json:"value"`
+			}{s.metric.name, export_ts(s.times[i]), v}
+			if err := enc.Encode(line); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func openmetrics_escape(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "\n", `\n`).Replace(s)
+}
+
+// openmetrics_name gives the name of the metric in expositions, which may not
+// begin with a digit.
+func openmetrics_name(m *metric) string {
+	if m.name[0] >= '0' && m.name[0] <= '9' {
+		return "_" + m.name
+	}
+	return m.name
+}
+
+// openmetrics_help gives the HELP and TYPE lines of a metric.
+func openmetrics_help(w io.Writer, m *metric) error {
+	name := openmetrics_name(m)
+	_, err := fmt.Fprintf(w,
+		"# HELP %s %s\n# TYPE %s gauge\n",
+		name, openmetrics_escape(m.description), name)
+	return err
+}
+
+// openmetrics_sample formats the timestamp as fractional seconds.
+func openmetrics_sample(w io.Writer, m *metric, v float64, ts time.Time) error {
+	_, err := fmt.Fprintf(w, "%s %s %s\n",
+		openmetrics_name(m),
+		strconv.FormatFloat(v, 'g', -1, 64),
+		strconv.FormatFloat(float64(ts.UnixMilli())/1000, 'f', -1, 64))
+	return err
+}
+
+func export_write_openmetrics(w io.Writer, series []*export_series) error {
+	for _, s := range series {
+		if err := openmetrics_help(w, s.metric); err != nil {
+			return err
+		}
+		for i, v := range s.values {
+			if math.IsNaN(v) {
+				continue
+			}
+			if err := openmetrics_sample(w, s.metric, v, s.times[i]); err != nil {
+				return err
+			}
+		}
+	}
+	_, err := fmt.Fprintln(w, "# EOF")
+	return err
+}
+
+func export_write(w io.Writer, format string, series []*export_series) error {
+	switch format {
+	case "csv":
+		return export_write_csv(w, series)
+	case "jsonl":
+		return export_write_jsonl(w, series)
+	case "openmetrics":
+		return export_write_openmetrics(w, series)
+	}
+	return fmt.Errorf("unknown format: %q", format)
+}
+
+func export(path_config string, names []string, opts *export_options) {
+	config, err := config_load_file(path_config)
+	if err != nil {
+		log.Fatal(err)
+	}
+	sconfig, err := config.parse_serve()
+	if err != nil {
+		log.Fatal(err)
+	}
+	metrics, err := config.parse_metrics()
+	if err != nil {
+		log.Fatal("config file reading failed, cannot proceed with export: ", err)
+	}
+	metrics = metrics_filter(metrics, metric_is_graphed)
+	selected := []*metric{}
+	for _, name := range names {
+		m := metric_find(metrics, name)
+		if m == nil {
+			log.Fatalf("unknown metric: %q\n", name)
+		}
+		if metric_is_derived(m) && !opts.binned {
+			log.Fatalf("derived metric can only be exported binned: %q\n", name)
+		}
+		selected = append(selected, m)
+	}
+	// Like in the graphs, the amount of bins is limited unless the bin width
+	// is given explicitly.
+	max_bins := math.MaxInt32
+	if opts.bin_width == 0 {
+		opts.bin_width = sconfig.bin_width
+		max_bins = sconfig.max_bins
+	}
+
+	now := time.Now()
+	if opts.raw_start == "" {
+		opts.raw_start = sconfig.default_period.String()
+	}
+	time_start, err := export_parse_time(opts.raw_start, now)
+	if err != nil {
+		log.Fatal("bad start: ", err)
+	}
+	time_end, err := export_parse_time(opts.raw_end, now)
+	if err != nil {
+		log.Fatal("bad end: ", err)
+	}
+	if !time_start.Before(time_end) {
+		log.Fatal("start should be before end")
+	}
+
+	if _, err := os.Stat(sconfig.path_db); err != nil {
+		log.Fatal("cannot open database: ", err)
+	}
+	db := db_init(db_path_serve(sconfig.path_db))
+	defer db.Close()
+	series := []*export_series{}
+	for _, m := range selected {
+		s, err := export_series_get(db, m, time_start, time_end, opts, max_bins)
+		if err != nil {
+			log.Fatalf("cannot get values for %s: %v\n", m.name, err)
+		}
+		series = append(series, s)
+	}
+	w := bufio.NewWriter(os.Stdout)
+	if err := export_write(w, opts.format, series); err != nil {
+		log.Fatal("export failed: ", err)
+	}
+	if err := w.Flush(); err != nil {
+		log.Fatal("export failed: ", err)
+	}
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Extractors pick the value from the command output so that it need not be
+// cleaned up with awk, cut, or jq. They are given as metric attributes like
+//
+//	extract=<name>|regex:<regex with a capture group>
+//	extract=<name>|json:<path like .data.items[0].value>
+//	extract=<name>|key:<key in key: value or key=value lines>
+type extractor struct {
+	kind string
+	re   *regexp.Regexp
+	path []interface{}
+	key  string
+}
+
+// extract_parse_path parses a jq-like path. Object keys are strings and array
+// indices ints.
+func extract_parse_path(raw string) ([]interface{}, error) {
+	ret := []interface{}{}
+	s := strings.TrimPrefix(strings.TrimSpace(raw), ".")
+	for len(s) > 0 {
+		switch {
+		case s[0] == '[':
+			end := strings.IndexByte(s, ']')
+			if end == -1 {
+				return nil, fmt.Errorf("unterminated index in %q", raw)
+			}
+			idx, err := strconv.Atoi(s[1:end])
+			if err != nil || idx < 0 {
+				return nil, fmt.Errorf("bad index in %q", raw)
+			}
+			ret = append(ret, idx)
+			s = s[end+1:]
+		case s[0] == '.':
+			s = s[1:]
+		default:
+			end := strings.IndexAny(s, ".[")
+			if end == -1 {
+				end = len(s)
+			}
+			ret = append(ret, s[:end])
+			s = s[end:]
+		}
+	}
+	return ret, nil
+}
+
+func extractor_parse(raw string) (*extractor, error) {
+	split := strings.SplitN(raw, ":", 2)
+	if len(split) != 2 || split[1] == "" {
+		return nil, errors.New("extractor should be like <kind>:<argument>")
+	}
+	e := &extractor{kind: split[0]}
+	switch e.kind {
+	case "regex":
+		re, err := regexp.Compile(split[1])
+		if err != nil {
+			return nil, err
+		}
+		if re.NumSubexp() == 0 {
+			return nil, errors.New("regex has no capture group")
+		}
+		e.re = re
+	case "json":
+		path, err := extract_parse_path(split[1])
+		if err != nil {
+			return nil, err
+		}
+		e.path = path
+	case "key":
+		e.key = strings.TrimSpace(split[1])
+	default:
+		return nil, fmt.Errorf("unknown extractor: %q", e.kind)
+	}
+	return e, nil
+}
+
+func extract_json(out string, path []interface{}) (string, error) {
+	dec := json.NewDecoder(strings.NewReader(out))
+	dec.UseNumber()
+	var cur interface{}
+	if err := dec.Decode(&cur); err != nil {
+		return "", fmt.Errorf("bad JSON: %w", err)
+	}
+	for _, elem := range path {
+		switch e := elem.(type) {
+		case string:
+			obj, ok := cur.(map[string]interface{})
+			if !ok {
+				return "", fmt.Errorf("not an object at %q", e)
+			}
+			if cur, ok = obj[e]; !ok {
+				return "", fmt.Errorf("no key %q", e)
+			}
+		case int:
+			arr, ok := cur.([]interface{})
+			if !ok {
+				return "", fmt.Errorf("not an array at [%d]", e)
+			}
+			if e >= len(arr) {
+				return "", fmt.Errorf("index [%d] out of range", e)
+			}
+			cur = arr[e]
+		}
+	}
+	switch v := cur.(type) {
+	case json.Number:
+		return v.String(), nil
+	case string:
+		return v, nil
+	case bool:
+		if v {
+			return "1", nil
+		}
+		return "0", nil
+	}
+	return "", fmt.Errorf("not a value: %v", cur)
+}
+
+// extract_key finds the first line with the key. The key is separated from the
+// value by whichever of `:` and `=` comes first.
+func extract_key(out, key string) (string, error) {
+	for _, line := range strings.Split(out, "\n") {
+		i := strings.IndexAny(line, ":=")
+		if i == -1 {
+			continue
+		}
+		if strings.TrimSpace(line[:i]) == key {
+			return strings.TrimSpace(line[i+1:]), nil
+		}
+	}
+	return "", fmt.Errorf("no key %q", key)
+}
+
+// extract returns the raw value from the command output.
+func (e *extractor) extract(out string) (string, error) {
+	switch e.kind {
+	case "regex":
+		m := e.re.FindStringSubmatch(out)
+		if m == nil {
+			return "", errors.New("regex did not match")
+		}
+		return strings.TrimSpace(m[1]), nil
+	case "json":
+		return extract_json(out, e.path)
+	case "key":
+		return extract_key(out, e.key)
+	}
+	panic(fmt.Sprintf("This is a bug: unknown extractor %q", e.kind))
+}
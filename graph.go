@@ -7,7 +7,9 @@ import (
 	"io"
 	"log"
 	"math"
+	"sort"
 	"strconv"
+	"strings"
 	"time"
 
 	"gonum.org/v1/plot"
@@ -19,6 +21,15 @@ func op_identity(i int, vals []float64, _ []time.Time) float64 {
 	return vals[i]
 }
 
+// op_previous returns the index of the previous value which is not NaN, or -1.
+func op_previous(i int, vals []float64) int {
+	previ := i - 1
+	for previ >= 0 && math.IsNaN(vals[previ]) {
+		previ--
+	}
+	return previ
+}
+
 func op_derivative(i int, vals []float64, times []time.Time) float64 {
 	if i == 0 {
 		return math.NaN()
@@ -29,26 +40,231 @@ func op_derivative(i int, vals []float64, times []time.Time) float64 {
 	// We go back as far as necessary to find a previous data point for the
 	// derivative. Error increases relative to the distance, but it's better
 	// than spitting out NaNs...
-	previ := i - 1
-	for previ >= 0 && math.IsNaN(vals[previ]) {
-		previ--
-	}
+	previ := op_previous(i, vals)
 	if previ == -1 {
 		return math.NaN()
 	}
 
-	seconds_now := times[i].Unix()
-	seconds_prev := times[previ].Unix()
-	delta_t := seconds_now - seconds_prev
+	delta_t := times[i].Sub(times[previ]).Seconds()
 	val_now := vals[i]
 	val_prev := vals[previ]
 	delta_v := val_now - val_prev
-	dv := delta_v / float64(delta_t)
+	dv := delta_v / delta_t
 	return dv
 }
 
-func bin_datapoints(dps []datapoint, bins int64, time_start, time_end time.Time, op bin_op) (
-	[]float64, []time.Time, float64, float64) {
+// op_rate returns the derivative per the given unit of time.
+func op_rate(per time.Duration) bin_op {
+	return func(i int, vals []float64, times []time.Time) float64 {
+		return op_derivative(i, vals, times) * per.Seconds()
+	}
+}
+
+// counter_delta returns the increase of a counter. A decreasing value means
+// that the counter has either wrapped around or been reset. If the width of the
+// counter is known, a wrap is assumed when it means an increase of at most half
+// of the counter's range. Otherwise the counter is assumed to have restarted
+// from zero.
+func counter_delta(prev, cur float64, width int) float64 {
+	delta_v := cur - prev
+	if delta_v >= 0 {
+		return delta_v
+	}
+	if width > 0 {
+		max := math.Pow(2, float64(width))
+		if wrapped := max - prev + cur; wrapped <= max/2 {
+			return wrapped
+		}
+	}
+	return cur
+}
+
+// counter_rates turns the stored values of a counter into its rates per the
+// given unit of time. This is done before binning, as a reset within a bin
+// would otherwise be hidden in the aggregate. Each rate has the time of the
+// later value.
+func counter_rates(dps []datapoint, width int, per time.Duration) []datapoint {
+	ret := []datapoint{}
+	for i := 1; i < len(dps); i++ {
+		delta_t := dps[i].ts.Sub(dps[i-1].ts).Seconds()
+		if delta_t <= 0 {
+			continue
+		}
+		delta_v := counter_delta(dps[i-1].value, dps[i].value, width)
+		ret = append(ret, datapoint{ts: dps[i].ts, value: delta_v / delta_t * per.Seconds()})
+	}
+	return ret
+}
+
+// op_chain applies the operations in order so that each sees the results of
+// the previous one. Bins are processed in order, so earlier results are kept
+// for operations which look back.
+func op_chain(ops []bin_op) bin_op {
+	results := make([][]float64, len(ops))
+	return func(i int, vals []float64, times []time.Time) float64 {
+		in := vals
+		for n, op := range ops {
+			for len(results[n]) <= i {
+				results[n] = append(results[n], math.NaN())
+			}
+			results[n][i] = op(i, in, times)
+			in = results[n]
+		}
+		return in[i]
+	}
+}
+
+// op_delta is the difference to the previous value without dividing by time.
+func op_delta(i int, vals []float64, _ []time.Time) float64 {
+	previ := op_previous(i, vals)
+	if previ == -1 {
+		return math.NaN()
+	}
+	return vals[i] - vals[previ]
+}
+
+// op_integral returns the cumulative integral per the given unit of time using
+// the trapezoidal rule. Missing values are skipped.
+func op_integral(per time.Duration) bin_op {
+	sums := []float64{}
+	return func(i int, vals []float64, times []time.Time) float64 {
+		sums = sums[:i]
+		previ := op_previous(i, vals)
+		sum := float64(0)
+		if previ != -1 {
+			delta_t := times[i].Sub(times[previ]).Seconds() / per.Seconds()
+			sum = sums[previ] + (vals[previ]+vals[i])/2*delta_t
+		}
+		if math.IsNaN(vals[i]) {
+			// The sum is carried over, but nothing is drawn.
+			if previ != -1 {
+				sum = sums[previ]
+			}
+			sums = append(sums, sum)
+			return math.NaN()
+		}
+		sums = append(sums, sum)
+		return sum
+	}
+}
+
+// transform_op returns the operation of a transform. The time unit is used by
+// integrals.
+func transform_op(t transform, per time.Duration) bin_op {
+	switch t.kind {
+	case "scale":
+		return func(i int, vals []float64, _ []time.Time) float64 { return vals[i] * t.x }
+	case "offset":
+		return func(i int, vals []float64, _ []time.Time) float64 { return vals[i] + t.x }
+	case "abs":
+		return func(i int, vals []float64, _ []time.Time) float64 { return math.Abs(vals[i]) }
+	case "clamp":
+		return func(i int, vals []float64, _ []time.Time) float64 {
+			return math.Max(t.x, math.Min(t.y, vals[i]))
+		}
+	case "delta":
+		return op_delta
+	case "integral":
+		return op_integral(per)
+	}
+	panic(fmt.Sprintf("This is a bug: unknown transform %q", t.kind))
+}
+
+func graph_has_integral(options *graph_options) bool {
+	for _, t := range options.transforms {
+		if t.kind == "integral" {
+			return true
+		}
+	}
+	return false
+}
+
+func agg_avg(vals []float64) float64 {
+	return agg_sum(vals) / float64(len(vals))
+}
+
+func agg_min(vals []float64) float64 {
+	ret := vals[0]
+	for _, v := range vals[1:] {
+		ret = math.Min(ret, v)
+	}
+	return ret
+}
+
+func agg_max(vals []float64) float64 {
+	ret := vals[0]
+	for _, v := range vals[1:] {
+		ret = math.Max(ret, v)
+	}
+	return ret
+}
+
+func agg_sum(vals []float64) float64 {
+	sum := float64(0)
+	for _, v := range vals {
+		sum += v
+	}
+	return sum
+}
+
+func agg_count(vals []float64) float64 {
+	return float64(len(vals))
+}
+
+func agg_last(vals []float64) float64 {
+	return vals[len(vals)-1]
+}
+
+// agg_percentile interpolates linearly between the closest ranks.
+func agg_percentile(p float64) bin_agg {
+	return func(vals []float64) float64 {
+		sorted := append([]float64{}, vals...)
+		sort.Float64s(sorted)
+		rank := p / 100 * float64(len(sorted)-1)
+		lo := int(math.Floor(rank))
+		hi := int(math.Ceil(rank))
+		return sorted[lo] + (sorted[hi]-sorted[lo])*(rank-float64(lo))
+	}
+}
+
+// agg_parse returns the bin aggregation by its name. Percentiles are given
+// like p95 or p99.9.
+func agg_parse(name string) (bin_agg, error) {
+	switch name {
+	case "avg":
+		return agg_avg, nil
+	case "min":
+		return agg_min, nil
+	case "max":
+		return agg_max, nil
+	case "sum":
+		return agg_sum, nil
+	case "count":
+		return agg_count, nil
+	case "last":
+		return agg_last, nil
+	case "median":
+		return agg_percentile(50), nil
+	}
+	if strings.HasPrefix(name, "p") {
+		p, err := strconv.ParseFloat(name[1:], 64)
+		if err == nil && p >= 0 && p <= 100 {
+			return agg_percentile(p), nil
+		}
+	}
+	return nil, fmt.Errorf("unknown aggregation: %q", name)
+}
+
+// metric_agg returns the name of the metric's bin aggregation.
+func metric_agg(metric *metric) string {
+	if metric.options.agg == "" {
+		return DEFAULT_BIN_AGG
+	}
+	return metric.options.agg
+}
+
+func bin_datapoints(dps []datapoint, bins int64, time_start, time_end time.Time, op bin_op,
+	agg bin_agg) ([]float64, []time.Time, float64, float64) {
 
 	if time_start.After(time_end) {
 		panic(
@@ -60,9 +276,10 @@ func bin_datapoints(dps []datapoint, bins int64, time_start, time_end time.Time,
 	binned := make([]float64, bins, bins)
 	result := make([]float64, bins, bins)
 	labels := make([]time.Time, bins, bins)
-	time_start_epoch := time_start.Unix()
-	time_end_epoch := time_end.Unix()
-	delta_t_bin_sec := (time_end_epoch - time_start_epoch) / bins
+	// Timestamps are handled with millisecond precision.
+	time_start_epoch := time_start.UnixMilli()
+	time_end_epoch := time_end.UnixMilli()
+	delta_t_bin_ms := (time_end_epoch - time_start_epoch) / bins
 	//
 	// First we place values into their bins:
 	//
@@ -71,18 +288,19 @@ func bin_datapoints(dps []datapoint, bins int64, time_start, time_end time.Time,
 	//      | ts1   ts2   ts3  |               ts4| ts5              |
 	//      '------------------+------------------+------------------.
 	//
-	// ... and afterwards the take an average of the in-bin-value.
+	// ... and afterwards the take an aggregate, usually an average, of the
+	// in-bin-values.
 	//
 	cur_dp_i := 0
-	ts_bin_left_sec := time_start_epoch
-	ts_bin_right_sec := time_start_epoch + delta_t_bin_sec
+	ts_bin_left_ms := time_start_epoch
+	ts_bin_right_ms := time_start_epoch + delta_t_bin_ms
 	val_min := math.NaN()
 	val_max := math.NaN()
+	bin_values_cur := []float64{}
 	// Loop through each bin and distribute datapoints inside them.
 	for cur_bin := int64(0); cur_bin < bins; cur_bin++ {
-		bin_value_sum_cur := float64(0)
-		n_datapoints_cur := 0
-		// First sum together datapoints belonging to this bin.
+		bin_values_cur = bin_values_cur[:0]
+		// First collect the datapoints belonging to this bin.
 		//
 		// When we look at a datapoint, there are three options:
 		//   1. It's before our current bin's time range
@@ -95,29 +313,29 @@ func bin_datapoints(dps []datapoint, bins int64, time_start, time_end time.Time,
 		//   3. End counting values because the bin is done
 		//
 		for cur_dp_i < len(dps) {
-			dp_sec := dps[cur_dp_i].ts.Unix()
-			if dp_sec < ts_bin_left_sec {
+			dp_ms := dps[cur_dp_i].ts.UnixMilli()
+			if dp_ms < ts_bin_left_ms {
 				cur_dp_i++
 				continue
 			}
-			if dp_sec >= ts_bin_left_sec && dp_sec <= ts_bin_right_sec {
-				bin_value_sum_cur += dps[cur_dp_i].value
-				n_datapoints_cur++
+			if dp_ms >= ts_bin_left_ms && dp_ms <= ts_bin_right_ms {
+				bin_values_cur = append(bin_values_cur, dps[cur_dp_i].value)
 				cur_dp_i++
 			} else {
 				break
 			}
 		}
-		// ... and then do the requested operation - usually average of
+		// ... and then do the requested aggregation - usually average of
 		// the current bin values.
+		n_datapoints_cur := len(bin_values_cur)
 		if n_datapoints_cur > 0 {
-			binned[cur_bin] = bin_value_sum_cur / float64(n_datapoints_cur)
+			binned[cur_bin] = agg(bin_values_cur)
 		} else {
 			binned[cur_bin] = math.NaN()
 		}
 
 		// Timestamp label is the average of bin left and right.
-		labels[cur_bin] = time.Unix((ts_bin_left_sec+ts_bin_right_sec)/2, 0)
+		labels[cur_bin] = time.UnixMilli((ts_bin_left_ms + ts_bin_right_ms) / 2)
 
 		// Do bin value transform before we interpret the value.
 		result[cur_bin] = op(
@@ -136,8 +354,8 @@ func bin_datapoints(dps []datapoint, bins int64, time_start, time_end time.Time,
 		}
 
 		// Slide bin timestamps over the next bin.
-		ts_bin_left_sec += delta_t_bin_sec
-		ts_bin_right_sec += delta_t_bin_sec
+		ts_bin_left_ms += delta_t_bin_ms
+		ts_bin_right_ms += delta_t_bin_ms
 	}
 	return result, labels, val_min, val_max
 }
@@ -240,23 +458,97 @@ func (NeatFloatTicker) Ticks(min, max float64) []plot.Tick {
 	return got
 }
 
-func graph_generate(db *sql.DB, metric *metric, force_no_ds bool,
-	time_start, time_end time.Time, w io.Writer, sconfig *config_serve) error {
+// graph_bins returns the amount of bins for the time range.
+func graph_bins(time_start, time_end time.Time, bin_width time.Duration, max_bins int) (int, error) {
 	// To have sensible graphs, the bin width (delta-t) should be
 	//   - equal or greater than our measurement period and
 	//   - smaller than the amount of horizontal pixels divided by some
 	//     small coefficient..
-	bins := int(time_end.Sub(time_start) / sconfig.bin_width)
-	if bins > sconfig.max_bins {
-		bins = sconfig.max_bins
+	bins := int(time_end.Sub(time_start) / bin_width)
+	if bins > max_bins {
+		bins = max_bins
 	}
 	if bins == 0 {
-		return errors.New("cannot graph zero bins")
+		return 0, errors.New("cannot graph zero bins")
 	}
+	return bins, nil
+}
 
-	t0 := time.Now()
+// metric_rate_unit returns the unit of time for derivatives and integrals.
+func metric_rate_unit(metric *metric) time.Duration {
+	if metric.options.rate_unit == 0 {
+		return time.Second
+	}
+	return metric.options.rate_unit
+}
+
+// metric_bin_op returns the operation which is done to the binned values of
+// the metric. Some operations keep state, so a new one is needed for each
+// binning.
+func metric_bin_op(metric *metric) bin_op {
+	per := metric_rate_unit(metric)
+	ops := []bin_op{}
+	// Counters are differentiated before binning.
+	switch {
+	case metric.options.counter:
+	case metric.options.differentiate && per != time.Second:
+		ops = append(ops, op_rate(per))
+	case metric.options.differentiate:
+		ops = append(ops, op_derivative)
+	}
+	for _, t := range metric.options.transforms {
+		ops = append(ops, transform_op(t, per))
+	}
+	switch len(ops) {
+	case 0:
+		return op_identity
+	case 1:
+		return ops[0]
+	}
+	return op_chain(ops)
+}
+
+// metric_binned_get returns the values of the metric binned and processed like
+// they are graphed.
+func metric_binned_get(db *sql.DB, metric *metric, force_no_ds bool, scale, bins int,
+	measure_period time.Duration, time_start, time_end time.Time) ([]float64, []time.Time, error) {
 
+	if metric_is_derived(metric) {
+		return derived_binned_get(
+			db, metric, force_no_ds, scale, bins, measure_period, time_start, time_end)
+	}
+	agg, err := agg_parse(metric_agg(metric))
+	if err != nil {
+		return nil, nil, err
+	}
+	// Dropping random rows only works for averages.
+	if metric_agg(metric) != "avg" {
+		force_no_ds = true
+	}
 	dps, err := db_datapoints_get(
+		db, metric, force_no_ds, scale, bins, measure_period, time_start, time_end)
+	if err != nil {
+		return nil, nil, err
+	}
+	if metric.options.counter {
+		dps = counter_rates(dps, metric.options.counter_width, metric_rate_unit(metric))
+	}
+	// Heavy lifting: obtain the binned data.
+	binned, labels, _, _ := bin_datapoints(
+		dps, int64(bins), time_start, time_end, metric_bin_op(metric), agg)
+	return binned, labels, nil
+}
+
+func graph_generate(db *sql.DB, metric *metric, force_no_ds bool,
+	time_start, time_end time.Time, w io.Writer, sconfig *config_serve) error {
+	bins, err := graph_bins(time_start, time_end, sconfig.bin_width, sconfig.max_bins)
+	if err != nil {
+		return err
+	}
+
+	t0 := time.Now()
+
+	binned, labels, err := metric_binned_get(
 		db, metric, force_no_ds, sconfig.downsampling_scale, bins,
 		sconfig.measure_period, time_start, time_end)
 	if err != nil {
@@ -266,14 +558,6 @@ func graph_generate(db *sql.DB, metric *metric, force_no_ds bool,
 
 	t1 := time.Now()
 
-	op := op_identity
-	if metric.options.differentiate {
-		op = op_derivative
-	}
-	// Heavy lifting: obtain the binned data.
-	binned, labels, _, _ := bin_datapoints(
-		dps, int64(bins), time_start, time_end, op)
-
 	xys := plotter.XYs{}
 	for i := 0; i < len(binned); i++ {
 		if math.IsNaN(binned[i]) {
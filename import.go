@@ -0,0 +1,267 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type import_options struct {
+	format, ts_format        string
+	header                   bool
+	skip_duplicates, dry_run bool
+}
+
+// import_parse_ts parses a timestamp with the given format, which is either
+// one of the named formats or a Go time layout. Layouts without a time zone
+// are interpreted in local time.
+func import_parse_ts(raw, format string) (time.Time, error) {
+	raw = strings.TrimSpace(raw)
+	// Unlike pushed values, imported values need a time of their own.
+	if raw == "" {
+		return time.Time{}, errors.New("missing timestamp")
+	}
+	switch format {
+	case "auto":
+		return push_parse_ts(raw)
+	case "unix":
+		secs, err := strconv.ParseFloat(raw, 64)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("bad Unix timestamp: %q", raw)
+		}
+		return time_from_unix(secs), nil
+	case "unix_ms":
+		ms, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("bad Unix timestamp: %q", raw)
+		}
+		return time.Unix(0, ms*int64(time.Millisecond)), nil
+	case "rfc3339":
+		return time.Parse(time.RFC3339Nano, raw)
+	}
+	return time.ParseInLocation(format, raw, time.Local)
+}
+
+func import_read_csv(r io.Reader, m *metric, opts *import_options) ([]*measurement, error) {
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = 2
+	cr.TrimLeadingSpace = true
+	cr.Comment = '#'
+	ret := []*measurement{}
+	for n := 1; ; n++ {
+		rec, err := cr.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if n == 1 && opts.header {
+			continue
+		}
+		line, _ := cr.FieldPos(0)
+		ts, err := import_parse_ts(rec[0], opts.ts_format)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		value, err := strconv.ParseFloat(strings.TrimSpace(rec[1]), 64)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: not floaty: %q", line, rec[1])
+		}
+		ret = append(ret, &measurement{metric: m, value: value, ts: ts})
+	}
+	return ret, nil
+}
+
+// import_read_jsonl reads lines like {"ts": <timestamp>, "value": <value>}.
+// The timestamp may be a string or a number.
+func import_read_jsonl(r io.Reader, m *metric, opts *import_options) ([]*measurement, error) {
+	s := bufio.NewScanner(r)
+	ret := []*measurement{}
+	for line := 1; s.Scan(); line++ {
+		if strings.TrimSpace(s.Text()) == "" {
+			continue
+		}
+		var v struct {
+			Ts    json.RawMessage `json:"ts"`
+			Value *float64        `json:"value"`
+		}
+		if err := json.Unmarshal(s.Bytes(), &v); err != nil {
+			return nil, fmt.Errorf("line %d: bad JSON: %w", line, err)
+		}
+		if v.Value == nil {
+			return nil, fmt.Errorf("line %d: missing value", line)
+		}
+		raw_ts := string(v.Ts)
+		if len(v.Ts) > 0 && v.Ts[0] == '"' {
+			if err := json.Unmarshal(v.Ts, &raw_ts); err != nil {
+				return nil, fmt.Errorf("line %d: %w", line, err)
+			}
+		}
+		if raw_ts == "" {
+			return nil, fmt.Errorf("line %d: missing timestamp", line)
+		}
+		ts, err := import_parse_ts(raw_ts, opts.ts_format)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		ret = append(ret, &measurement{metric: m, value: *v.Value, ts: ts})
+	}
+	return ret, s.Err()
+}
+
+// import_existing returns the timestamps which the metric already has between
+// the earliest and the latest of the measurements.
+func import_existing(db *sql.DB, m *metric, ms []*measurement) (map[string]bool, error) {
+	ret := map[string]bool{}
+	if len(ms) == 0 {
+		return ret, nil
+	}
+	exists, err := db_table_exists(db, db_table_name_get(m))
+	if err != nil || !exists {
+		return ret, err
+	}
+	first, last := ms[0].ts, ms[0].ts
+	for _, cur := range ms[1:] {
+		if cur.ts.Before(first) {
+			first = cur.ts
+		}
+		if cur.ts.After(last) {
+			last = cur.ts
+		}
+	}
+	rows, err := db.Query(
+		fmt.Sprintf(`SELECT timestamp FROM %s WHERE timestamp BETWEEN ? AND ?`,
+			db_table_name_get(m)),
+		db_timestamp(first), db_timestamp(last))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var ts time.Time
+		if err := rows.Scan(&ts); err != nil {
+			return nil, err
+		}
+		ret[db_timestamp(ts)] = true
+	}
+	return ret, rows.Err()
+}
+
+// import_measurements writes the measurements and returns how many were
+// inserted and skipped as duplicates. The values are committed in batches, so
+// on error the values inserted before it are kept and counted.
+func import_measurements(db *sql.DB, m *metric, ms []*measurement,
+	opts *import_options) (int, int, error) {
+
+	existing := map[string]bool{}
+	// A dry run without a database has nothing to compare to.
+	if opts.skip_duplicates && db != nil {
+		var err error
+		if existing, err = import_existing(db, m, ms); err != nil {
+			return 0, 0, fmt.Errorf("cannot check for duplicates: %w", err)
+		}
+	}
+	pending, skipped := []*measurement{}, 0
+	for _, cur := range ms {
+		ts := db_timestamp(cur.ts)
+		if opts.skip_duplicates && existing[ts] {
+			skipped++
+			continue
+		}
+		existing[ts] = true
+		pending = append(pending, cur)
+	}
+	if opts.dry_run {
+		return len(pending), skipped, nil
+	}
+	if err := db_migrate(db, []*metric{m}); err != nil {
+		return 0, skipped, err
+	}
+	inserted := 0
+	for len(pending) > 0 {
+		n := IMPORT_BATCH_SIZE
+		if n > len(pending) {
+			n = len(pending)
+		}
+		written, err := db_insert(context.Background(), db, pending[:n])
+		inserted += written
+		if err != nil {
+			return inserted, skipped, err
+		}
+		pending = pending[n:]
+	}
+	return inserted, skipped, nil
+}
+
+func import_values(path_config, name, path_input string, opts *import_options) {
+	config, err := config_load_file(path_config)
+	if err != nil {
+		log.Fatal(err)
+	}
+	mconfig, err := config.parse_measure()
+	if err != nil {
+		log.Fatal(err)
+	}
+	metrics, err := config.parse_metrics()
+	if err != nil {
+		log.Fatal("config file reading failed, cannot proceed with import: ", err)
+	}
+	m := metric_find(metrics_filter(metrics, metric_is_stored), name)
+	if m == nil {
+		log.Fatalf("unknown metric: %q\n", name)
+	}
+
+	in := os.Stdin
+	if path_input != "-" {
+		f, err := os.Open(path_input)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer f.Close()
+		in = f
+	}
+	var ms []*measurement
+	switch opts.format {
+	case "csv":
+		ms, err = import_read_csv(in, m, opts)
+	case "jsonl":
+		ms, err = import_read_jsonl(in, m, opts)
+	default:
+		err = fmt.Errorf("unknown format: %q", opts.format)
+	}
+	if err != nil {
+		log.Fatal("cannot read values: ", err)
+	}
+	log.Println("read", len(ms), "values for", m.name)
+
+	var db *sql.DB
+	if _, err := os.Stat(mconfig.path_db); err == nil || !opts.dry_run {
+		path_db := db_path_measure(mconfig.path_db)
+		if opts.dry_run {
+			path_db = db_path_serve(mconfig.path_db)
+		}
+		log.Println("Opening SQLite DB at ", path_db)
+		db = db_init(path_db)
+		defer db.Close()
+	}
+	inserted, skipped, err := import_measurements(db, m, ms, opts)
+	if err != nil {
+		log.Fatalf("import failed after inserting %d values: %v\n", inserted, err)
+	}
+	if opts.dry_run {
+		fmt.Printf("dry run: would insert %d values, skip %d duplicates\n", inserted, skipped)
+	} else {
+		fmt.Printf("inserted %d values, skipped %d duplicates\n", inserted, skipped)
+	}
+}
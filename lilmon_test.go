@@ -3,11 +3,20 @@ package main
 import (
 	"bytes"
 	"context"
+	"database/sql"
+	"errors"
 	"fmt"
+	"html/template"
 	"image/color"
 	"math"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
 	"path/filepath"
 	"reflect"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 )
@@ -20,6 +29,11 @@ measure_period=150s
 retention_time=21600h
 prune_db_period=300m
 shell=/bin/zsh
+max_concurrent_commands=3
+shutdown_timeout=5s
+write_batch_size=50
+write_batch_delay=2s
+push_addr=unix:/somewhere/push.sock
 
 [serve]
 listen_addr=localhost:15516
@@ -45,6 +59,13 @@ metric=n_temp_files|Files in /tmp|y_min=0,kilo|find /tmp/ -type f|wc -l
 metric=n_processes|Visible processes (all users)|y_min=0,y_max=1000|ps -A|wc -l
 metric=rate_logged_in_users|Rate of user logins|deriv|who|wc -l
 metric="n_subshell_constant|Plain silly||{ echo -n \"one\"; echo -n two; echo -n three; }|wc -c"
+metric=n_users|Logged in users|period=10m|who|wc -l
+metric=n_cron|Cron-scheduled||echo 1
+cron=n_cron|*/15 8-17 * * 1-5
+metric=net|Network counters||printf 'rx 1\ntx=2\n'
+series=net|rx|Received|deriv,kilo
+series=net|tx|Transmitted|deriv
+metric=backup_duration|Backup duration|y_min=0|
 `
 
 var test_metrics = []*metric{
@@ -76,6 +97,21 @@ func almost_equals(a, b float64) bool {
 	return math.Abs(a-b) < 0.001
 }
 
+// test_writer starts a writer. Everything sent to it has been written once
+// the returned function returns.
+func test_writer(db *sql.DB, batch_size int, batch_delay time.Duration) (chan db_task, func()) {
+	tc := make(chan db_task)
+	done := make(chan struct{})
+	go func() {
+		db_writer(context.Background(), db, tc, batch_size, batch_delay)
+		close(done)
+	}()
+	return tc, func() {
+		close(tc)
+		<-done
+	}
+}
+
 func TestBinDatapoints(t *testing.T) {
 	ta, _ := time.Parse(time.RFC3339, "2020-01-01T12:00:00Z")
 	tb, _ := time.Parse(time.RFC3339, "2020-01-01T13:00:00Z")
@@ -128,7 +164,7 @@ func TestBinDatapoints(t *testing.T) {
 	}
 
 	got_values, got_labels, got_min, got_max := bin_datapoints(
-		dps, int64(bins), ta, tb, test_op_ident)
+		dps, int64(bins), ta, tb, test_op_ident, agg_avg)
 	t.Log("got_values:        ", got_values)
 	t.Log("got_labels:        ", got_labels)
 	t.Log("recorded_prev_vals:", recorded_prev_vals)
@@ -187,6 +223,333 @@ func TestBinDatapoints(t *testing.T) {
 	}
 }
 
+func TestCounterDerivative(t *testing.T) {
+	ta, _ := time.Parse(time.RFC3339, "2020-01-01T12:00:00Z")
+	max32 := math.Pow(2, 32)
+	table := []struct {
+		name  string
+		vals  []float64
+		width int
+		per   time.Duration
+		want  []float64
+	}{
+		{
+			// The missing value is a gap of two minutes.
+			name: "increasing",
+			vals: []float64{0, 60, 120, math.NaN(), 240, 300},
+			per:  time.Second,
+			want: []float64{1, 1, 1, 1},
+		},
+		{
+			name: "reset",
+			vals: []float64{1000, 1060, 60, 120, 180, 240},
+			per:  time.Minute,
+			want: []float64{60, 60, 60, 60, 60},
+		},
+		{
+			name:  "wrap",
+			vals:  []float64{max32 - 120, max32 - 60, 0, 60, 120, 180},
+			width: 32,
+			per:   time.Hour,
+			want:  []float64{3600, 3600, 3600, 3600, 3600},
+		},
+		{
+			name:  "reset with width",
+			vals:  []float64{1000, 1060, 60, 120, 180, 240},
+			width: 32,
+			per:   time.Second,
+			want:  []float64{1, 1, 1, 1, 1},
+		},
+	}
+	for _, tt := range table {
+		dps := []datapoint{}
+		for i, val := range tt.vals {
+			if !math.IsNaN(val) {
+				dps = append(dps, datapoint{ts: ta.Add(time.Duration(i) * time.Minute), value: val})
+			}
+		}
+		got := []float64{}
+		for _, dp := range counter_rates(dps, tt.width, tt.per) {
+			got = append(got, dp.value)
+		}
+		assertf(t, len(got) == len(tt.want), "%s: wanted %v, got %v", tt.name, tt.want, got)
+		for i := 0; i < len(got) && i < len(tt.want); i++ {
+			assertf(t, almost_equals(got[i], tt.want[i]),
+				"%s: [%d] wanted %f, got %f", tt.name, i, tt.want[i], got[i])
+		}
+	}
+
+	// The plain derivative may be given per minute.
+	times := []time.Time{ta, ta.Add(time.Minute)}
+	m := &metric{name: "m", options: graph_options{differentiate: true, rate_unit: time.Minute}}
+	got := metric_bin_op(m)(1, []float64{0, 60}, times)
+	assert(t, almost_equals(got, 60), "unexpected rate per minute", got)
+
+	// A counter rising 1000 per second is measured twice per bin. A reset
+	// or a wrap within a bin must not show up in its average.
+	db := db_init(filepath.Join(t.TempDir(), "test.db"))
+	defer db.Close()
+	reset := &metric{name: "reset", options: graph_options{counter: true}}
+	wrap := &metric{name: "wrap", options: graph_options{counter: true, counter_width: 32}}
+	err := db_migrate(db, []*metric{reset, wrap})
+	assert(t, err == nil, "cannot migrate:", err)
+	tc, stop := test_writer(db, DEFAULT_WRITE_BATCH_SIZE, time.Hour)
+	for i := 0; i <= 10; i++ {
+		ts := ta.Add(time.Duration(i) * 30 * time.Second)
+		val := 4e9 + float64(i)*30000
+		if i >= 5 {
+			val = float64(i-4) * 30000
+		}
+		measurement_send(reset, val, ts, tc)
+		measurement_send(wrap, math.Mod(max32-75000+float64(i)*30000, max32), ts, tc)
+	}
+	stop()
+	for _, m := range []*metric{reset, wrap} {
+		got, _, err := metric_binned_get(db, m, true, 1, 5, time.Minute, ta, ta.Add(5*time.Minute))
+		assert(t, err == nil, "cannot get binned values:", err)
+		for i, val := range got {
+			assertf(t, almost_equals(val, 1000), "%s: [%d] wanted 1000, got %f", m.name, i, val)
+		}
+	}
+}
+
+func TestTransforms(t *testing.T) {
+	ta, _ := time.Parse(time.RFC3339, "2020-01-01T12:00:00Z")
+	times := []time.Time{}
+	for i := 0; i < 5; i++ {
+		times = append(times, ta.Add(time.Duration(i)*time.Hour))
+	}
+	nan := math.NaN()
+	table := []struct {
+		options string
+		vals    []float64
+		want    []float64
+	}{
+		{"scale=8", []float64{1, 2, nan, 4, 5}, []float64{8, 16, nan, 32, 40}},
+		{"offset=-273.15,clamp=0:", []float64{273.15, 263.15, 300, nan, 373.15}, []float64{0, 0, 26.85, nan, 100}},
+		{"abs,scale=-1", []float64{-1, 2, -3, 4, -5}, []float64{-1, -2, -3, -4, -5}},
+		{"scale=-1,abs", []float64{-1, 2, -3, 4, -5}, []float64{1, 2, 3, 4, 5}},
+		{"delta", []float64{10, 15, nan, 12, 12}, []float64{nan, 5, nan, -3, 0}},
+		{"clamp=2:3", []float64{1, 2, 2.5, 3, 4}, []float64{2, 2, 2.5, 3, 3}},
+		// Constant power of 100 W for hours is 360 kJ per hour.
+		{"integral", []float64{100, 100, nan, 100, 100}, []float64{0, 360000, nan, 1080000, 1440000}},
+		{"integral,rate=h", []float64{100, 100, 200, 200, nan}, []float64{0, 100, 250, 450, nan}},
+		// The derivative is taken first: 3600 per hour is 1 per second.
+		{"deriv,scale=8", []float64{0, 3600, 7200, 10800, 14400}, []float64{nan, 8, 8, 8, 8}},
+		{"deriv,delta,abs", []float64{0, 3600, 10800, 3600, 7200}, []float64{nan, nan, 1, 4, 3}},
+	}
+	for _, tt := range table {
+		options, _, errs := config_parse_metric_options(tt.options)
+		assert(t, len(errs) == 0, "cannot parse options", tt.options, errs)
+		m := &metric{name: "m", options: options}
+		// The same operation is used twice to see that its state is reset.
+		for round := 0; round < 2; round++ {
+			op := metric_bin_op(m)
+			for i := range tt.vals {
+				got := op(i, tt.vals, times)
+				if math.IsNaN(tt.want[i]) {
+					assertf(t, math.IsNaN(got), "%s: [%d] should be NaN, got %f", tt.options, i, got)
+					continue
+				}
+				assertf(t, almost_equals(got, tt.want[i]),
+					"%s: [%d] wanted %f, got %f", tt.options, i, tt.want[i], got)
+			}
+		}
+	}
+
+	options, _, errs := config_parse_metric_options("scale=8,abs,clamp=:10")
+	want := []transform{{kind: "scale", x: 8}, {kind: "abs"}, {kind: "clamp", x: math.Inf(-1), y: 10}}
+	assert(t, len(errs) == 0 && reflect.DeepEqual(options.transforms, want),
+		"unexpected transforms", options.transforms, errs)
+	for _, bad := range []string{"scale", "offset=x", "clamp", "clamp=5:1", "clamp=a:b", "rate=h"} {
+		_, _, errs := config_parse_metric_options(bad)
+		assertf(t, len(errs) > 0, "%q should not parse", bad)
+	}
+}
+
+func TestBinAggregation(t *testing.T) {
+	vals := []float64{4, 1, 3, 2, 10}
+	for _, tt := range []struct {
+		name string
+		want float64
+	}{
+		{"avg", 4}, {"min", 1}, {"max", 10}, {"sum", 20}, {"count", 5}, {"last", 10},
+		{"median", 3}, {"p0", 1}, {"p100", 10}, {"p25", 2}, {"p87.5", 7},
+	} {
+		agg, err := agg_parse(tt.name)
+		assert(t, err == nil, "cannot parse aggregation", tt.name, err)
+		if err != nil {
+			continue
+		}
+		got := agg(vals)
+		assertf(t, almost_equals(got, tt.want), "%s: wanted %f, got %f", tt.name, tt.want, got)
+	}
+	assert(t, reflect.DeepEqual(vals, []float64{4, 1, 3, 2, 10}), "values were modified", vals)
+	for _, bad := range []string{"", "mean", "p", "p101", "p-1", "pxx"} {
+		_, err := agg_parse(bad)
+		assertf(t, err != nil, "%q should not parse", bad)
+	}
+
+	ta, _ := time.Parse(time.RFC3339, "2020-01-01T12:00:00Z")
+	dps := []datapoint{
+		{ts: ta.Add(10 * time.Second), value: 1},
+		{ts: ta.Add(20 * time.Second), value: 100},
+		{ts: ta.Add(70 * time.Second), value: 5},
+	}
+	binned, _, got_min, got_max := bin_datapoints(
+		dps, 3, ta, ta.Add(3*time.Minute), op_identity, agg_max)
+	assert(t, binned[0] == 100 && binned[1] == 5 && math.IsNaN(binned[2]),
+		"unexpected binned maximums", binned)
+	assert(t, got_min == 5 && got_max == 100, "unexpected min and max", got_min, got_max)
+
+	options, _, errs := config_parse_metric_options("agg=P99")
+	assert(t, len(errs) == 0 && options.agg == "p99", "unexpected agg", options.agg, errs)
+	_, _, errs = config_parse_metric_options("agg=mode")
+	assert(t, len(errs) == 1, "bad agg should fail")
+
+	db := db_init(filepath.Join(t.TempDir(), "test.db"))
+	defer db.Close()
+	metrics := []*metric{
+		{name: "latency", options: graph_options{agg: "p95"}},
+		{name: "load"},
+	}
+	err := db_migrate(db, metrics)
+	assert(t, err == nil, "cannot migrate:", err)
+	tmpl := template.Must(template.New("index").Parse(
+		"{{ range .Metrics }}{{ .Name }}={{ .Aggregation }};{{ end }}"))
+	state := &serve_state{}
+	state.set(metrics, &config_serve{default_period: time.Hour}, tmpl)
+	for _, tt := range []struct {
+		url, want string
+		code      int
+	}{
+		{"/", "latency=p95;load=avg;", http.StatusOK},
+		{"/?agg=max", "latency=max;load=max;", http.StatusOK},
+		{"/?agg=nope", "bad aggregation\n", http.StatusBadRequest},
+	} {
+		w := httptest.NewRecorder()
+		serve_index_gen(db, state, "index")(w, httptest.NewRequest("GET", tt.url, nil))
+		assertf(t, w.Code == tt.code && w.Body.String() == tt.want,
+			"%s: unexpected response %d %q", tt.url, w.Code, w.Body.String())
+	}
+	w := httptest.NewRecorder()
+	serve_graph_gen(db, state, "graph")(w, httptest.NewRequest(
+		"GET", "/graph?metric=load&epoch_start=0&epoch_end=60&agg=nope", nil))
+	assert(t, w.Code == http.StatusBadRequest, "bad aggregation should fail", w.Code)
+	assert(t, metrics[1].options.agg == "", "override changed the metric")
+}
+
+func TestDerived(t *testing.T) {
+	used, total := &metric{name: "used"}, &metric{name: "total"}
+	inf, nan := &metric{name: "inf"}, &metric{name: "nan"}
+	inputs := map[*metric][]float64{used: {3}, total: {4}, inf: {5}, nan: {2}}
+	for _, tt := range []struct {
+		raw  string
+		want float64
+	}{
+		{"used/total*100", 75},
+		{"used + total * 2", 11},
+		{"(used + total) * 2", 14},
+		{"total - used - 1", 0},
+		{"-used + 0.5", -2.5},
+		{"--used", 3},
+		{"total / (used - 3)", math.NaN()},
+		{"used * 1e-3 + 2.5E+1 - .5", 24.503},
+		{"inf + nan", 7},
+	} {
+		e, err := expr_parse(tt.raw)
+		assertf(t, err == nil, "%q should parse: %v", tt.raw, err)
+		if err != nil {
+			continue
+		}
+		err = e.resolve([]*metric{used, total, inf, nan})
+		assertf(t, err == nil, "%q should resolve: %v", tt.raw, err)
+		got := e.eval(0, inputs)
+		if math.IsNaN(tt.want) {
+			assertf(t, math.IsNaN(got), "%q should be NaN, got %f", tt.raw, got)
+			continue
+		}
+		assertf(t, almost_equals(got, tt.want), "%q: wanted %f, got %f", tt.raw, tt.want, got)
+	}
+	for _, bad := range []string{"", "used +", "(used", "used)", "used total", "used % 2", "* used"} {
+		_, err := expr_parse(bad)
+		assertf(t, err != nil, "%q should not parse", bad)
+	}
+
+	c, err := config_load(strings.NewReader(`path_db=/somewhere/db.sqlite
+[metrics]
+derived=mem_pct|Memory used (%)|y_min=0|mem_used / mem_total * 100
+metric=mem_used|Memory used||echo 1
+metric=mem_total|Memory total||echo 2
+derived=mem_peak_pct|Memory peak (%)|agg=max|mem_used/mem_total*100
+`))
+	assert(t, err == nil, "cannot load config:", err)
+	metrics, err := c.parse_metrics()
+	assert(t, err == nil, "cannot parse metrics:", err)
+	names := []string{}
+	for _, m := range metrics {
+		names = append(names, m.name)
+	}
+	want := []string{"mem_used", "mem_total", "mem_pct", "mem_peak_pct"}
+	assert(t, reflect.DeepEqual(names, want), "unexpected metrics", names)
+	if len(metrics) != len(want) {
+		return
+	}
+	pct, peak := metrics[2], metrics[3]
+	assert(t, !metric_is_stored(pct) && !metric_is_measured(pct) && metric_is_graphed(pct),
+		"derived metric should only be graphed")
+	assert(t, reflect.DeepEqual(pct.derived.inputs(), metrics[:2]), "unexpected inputs")
+
+	for _, bad := range []string{
+		"derived=d|D||nope * 2\n",
+		"derived=d|D||m +\n",
+		"derived=d|D|duration|m\n",
+		"derived=d|D|counter|m\n",
+		"derived=d|D||m\nderived=e|E||d\n",
+		"derived=m|D||m * 2\n",
+		"derived=lilmon_d|D||m\n",
+		"derived=d|D\n",
+		"cron=d|* * * * *\nderived=d|D||m\n",
+	} {
+		c, err := config_load(strings.NewReader(
+			"path_db=/somewhere/db.sqlite\n[metrics]\nmetric=m|M||echo 1\n" + bad))
+		assert(t, err == nil, "cannot load config:", err)
+		_, err = c.parse_metrics()
+		assertf(t, err != nil, "%q should not parse", bad)
+	}
+
+	db := db_init(filepath.Join(t.TempDir(), "test.db"))
+	defer db.Close()
+	err = db_migrate(db, metrics_filter(metrics, metric_is_stored))
+	assert(t, err == nil, "cannot migrate:", err)
+	ts, _ := time.Parse(time.RFC3339, "2022-09-01T12:00:00Z")
+	tc, stop := test_writer(db, DEFAULT_WRITE_BATCH_SIZE, time.Hour)
+	measurement_send(metrics[0], 30, ts.Add(10*time.Minute), tc)
+	measurement_send(metrics[0], 50, ts.Add(20*time.Minute), tc)
+	measurement_send(metrics[1], 80, ts.Add(15*time.Minute), tc)
+	// The second bin has no total, so nothing is computed for it.
+	measurement_send(metrics[0], 20, ts.Add(70*time.Minute), tc)
+	stop()
+
+	for _, tt := range []struct {
+		m    *metric
+		want float64
+	}{
+		{pct, 50},
+		{peak, 62.5},
+	} {
+		got, labels, err := metric_binned_get(
+			db, tt.m, true, 1, 2, time.Minute, ts, ts.Add(2*time.Hour))
+		assert(t, err == nil, "cannot get binned values:", err)
+		assert(t, len(got) == 2 && len(labels) == 2, "unexpected amount of bins", got, labels)
+		if len(got) != 2 {
+			continue
+		}
+		assertf(t, almost_equals(got[0], tt.want), "%s: wanted %f, got %f", tt.m.name, tt.want, got[0])
+		assertf(t, math.IsNaN(got[1]), "%s: second bin should be NaN, got %f", tt.m.name, got[1])
+	}
+}
+
 func TestMetricNames(t *testing.T) {
 	valid_names := []string{
 		"some_metric_1",
@@ -249,6 +612,74 @@ func TestDatabaseSmoke(t *testing.T) {
 
 }
 
+func TestDatabaseBatches(t *testing.T) {
+	db := db_init(filepath.Join(t.TempDir(), "test.db"))
+	defer db.Close()
+	err := db_migrate(db, test_metrics)
+	assert(t, err == nil, "cannot migrate:", err)
+	m := test_metrics[0]
+	count := func() int {
+		var n int
+		err := db.QueryRow(
+			fmt.Sprintf(`SELECT COUNT(*) FROM %s`, db_table_name_get(m))).Scan(&n)
+		assert(t, err == nil, "cannot count:", err)
+		return n
+	}
+
+	tc, stop := test_writer(db, 2, 100*time.Millisecond)
+	for i := 0; i < 3; i++ {
+		measurement_send(m, float64(i), time.Now(), tc)
+	}
+	// The first batch was full and the last value is still pending.
+	assert(t, count() == 2, "unexpected count after a full batch:", count())
+	time.Sleep(500 * time.Millisecond)
+	assert(t, count() == 3, "unexpected count after the batch delay:", count())
+
+	measurement_send(m, 4, time.Now(), tc)
+	stop()
+	assert(t, count() == 4, "unexpected count after stopping:", count())
+}
+
+func TestDatabaseTimestamps(t *testing.T) {
+	db := db_init(filepath.Join(t.TempDir(), "test.db"))
+	defer db.Close()
+	err := db_migrate(db, test_metrics)
+	assert(t, err == nil, "cannot migrate:", err)
+	m := test_metrics[0]
+
+	// An old row with second precision and two new ones within the same
+	// second.
+	ts, _ := time.Parse(time.RFC3339, "2022-09-01T12:00:00Z")
+	_, err = db.Exec(
+		fmt.Sprintf(`INSERT INTO %s (value, timestamp) VALUES (?, DATETIME(?, 'unixepoch'))`,
+			db_table_name_get(m)),
+		1, ts.Unix())
+	assert(t, err == nil, "cannot insert:", err)
+
+	tc, stop := test_writer(db, DEFAULT_WRITE_BATCH_SIZE, time.Hour)
+	measurement_send(m, 2, ts.Add(250*time.Millisecond), tc)
+	measurement_send(m, 3, ts.Add(500*time.Millisecond), tc)
+	stop()
+
+	dps, err := db_datapoints_get(
+		db, m, true, 1, 10, time.Second, ts, ts.Add(time.Second))
+	assert(t, err == nil, "cannot get datapoints:", err)
+	assert(t, len(dps) == 3, "unexpected amount of datapoints:", len(dps))
+	for n, want := range []time.Duration{0, 250 * time.Millisecond, 500 * time.Millisecond} {
+		if n >= len(dps) {
+			break
+		}
+		assertf(t, dps[n].ts.Equal(ts.Add(want)) && almost_equals(dps[n].value, float64(n+1)),
+			"unexpected datapoint %d: %v", n, dps[n])
+	}
+
+	// The latest value is after the end.
+	dps, err = db_datapoints_get(
+		db, m, true, 1, 10, time.Second, ts, ts.Add(300*time.Millisecond))
+	assert(t, err == nil, "cannot get datapoints:", err)
+	assert(t, len(dps) == 2, "unexpected amount of datapoints:", len(dps))
+}
+
 func TestMeasureMetric(t *testing.T) {
 	// Just in case...
 	ctx, cf := context.WithTimeout(context.Background(), 30*time.Second)
@@ -265,6 +696,1003 @@ func TestMeasureMetric(t *testing.T) {
 	}
 }
 
+func TestMeasureMetricRetries(t *testing.T) {
+	ctx, cf := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cf()
+	// The command fails until it has been run three times.
+	counter := filepath.Join(t.TempDir(), "counter")
+	m := &metric{
+		name:    "flaky",
+		command: fmt.Sprintf(`echo x >> %s; test $(wc -l < %s) -ge 3 && echo 42`, counter, counter),
+		measure: measure_options{retries: 2, retry_backoff: time.Millisecond},
+	}
+	tc := make(chan db_task, 1)
+	exec_metric_retrying(ctx, m, "/bin/sh", 1, 10*time.Second, tc)
+	close(tc)
+	result, ok := <-tc
+	assert(t, ok, "no measurement after retries")
+	if ok {
+		assert(t, almost_equals(result.insert_measurement.value, 42),
+			"unexpected value", result.insert_measurement.value)
+	}
+
+	m.measure.timeout = 50 * time.Millisecond
+	m.command = "sleep 5"
+	m.measure.retries = 0
+	t0 := time.Now()
+	tc = make(chan db_task, 1)
+	exec_metric_retrying(ctx, m, "/bin/sh", 2, metric_timeout(m, time.Minute), tc)
+	assert(t, time.Since(t0) < 4*time.Second, "timeout was not honored")
+	result = <-tc
+	assert(t, result.kind == DB_TASK_FAILURE, "timed out command should fail", result.kind)
+	if result.kind == DB_TASK_FAILURE {
+		assert(t, result.insert_failure.reason == "timed out",
+			"unexpected failure reason", result.insert_failure.reason)
+	}
+}
+
+func TestMeasureShutdown(t *testing.T) {
+	table := []struct {
+		command  string
+		timeout  time.Duration
+		measured bool
+	}{
+		{"sleep 0.3; echo 7", 10 * time.Second, true},
+		{"sleep 10; echo 7", 200 * time.Millisecond, false},
+	}
+	for _, tt := range table {
+		ctx, cf := context.WithCancel(context.Background())
+		exec_ctx, exec_cf := context.WithCancel(context.Background())
+		tc := make(chan db_task, 1)
+		jobs := make(chan measure_job, 2)
+		var wg sync.WaitGroup
+		wg.Add(1)
+		go measure_worker(ctx, exec_ctx, "/bin/sh", jobs, tc, &wg)
+		m := &metric{name: "slow", command: tt.command}
+		jobs <- measure_job{metric: m, ord: 1, timeout: time.Minute, busy: new(int32)}
+		// Give the worker time to start the first job. The second one
+		// stays queued and is dropped.
+		time.Sleep(100 * time.Millisecond)
+		jobs <- measure_job{metric: m, ord: 2, timeout: time.Minute, busy: new(int32)}
+		cf()
+		t0 := time.Now()
+		measure_workers_stop(jobs, &wg, exec_cf, tt.timeout)
+		assertf(t, time.Since(t0) < 5*time.Second, "%q: stopping took too long", tt.command)
+		close(tc)
+		n := 0
+		for result := range tc {
+			n++
+			assertf(t, result.kind == DB_TASK_INSERT && almost_equals(result.insert_measurement.value, 7),
+				"%q: unexpected result %v", tt.command, result)
+		}
+		assertf(t, (n == 1) == tt.measured, "%q: unexpected amount of results: %d", tt.command, n)
+	}
+}
+
+func TestMeasureMetricFailures(t *testing.T) {
+	ctx, cf := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cf()
+	table := []struct {
+		command, reason string
+		exit_code       int
+		stderr          string
+	}{
+		{"echo oops >&2; exit 3", "exit status 3", 3, "oops\n"},
+		{"echo abc", `not a number: "abc"`, 0, ""},
+	}
+	for _, entry := range table {
+		m := &metric{name: "failing", command: entry.command}
+		f := exec_metric(ctx, m, "/bin/sh", 1, nil)
+		if f == nil {
+			t.Errorf("%q should fail but did not", entry.command)
+			continue
+		}
+		assertf(t, f.reason == entry.reason, "unexpected reason: %q", f.reason)
+		assertf(t, f.exit_code == entry.exit_code, "unexpected exit code: %d", f.exit_code)
+		assertf(t, f.stderr == entry.stderr, "unexpected stderr: %q", f.stderr)
+	}
+
+	tb := truncating_buffer{limit: 4}
+	fmt.Fprint(&tb, "abc")
+	fmt.Fprint(&tb, "defg")
+	assert(t, tb.String() == "abcd", "unexpected truncation", tb.String())
+}
+
+func TestDatabaseFailures(t *testing.T) {
+	time_start := time.Now().Add(-time.Minute)
+	db := db_init(filepath.Join(t.TempDir(), "test.db"))
+	defer db.Close()
+	err := db_migrate(db, test_metrics)
+	assert(t, err == nil, "cannot migrate:", err)
+
+	tc, stop := test_writer(db, DEFAULT_WRITE_BATCH_SIZE, time.Hour)
+	m := test_metrics[0]
+	tc <- db_task{
+		kind:           DB_TASK_FAILURE,
+		insert_failure: &measurement_failure{metric: m, reason: "first", exit_code: 1, ts: time.Now()},
+	}
+	tc <- db_task{
+		kind: DB_TASK_FAILURE,
+		insert_failure: &measurement_failure{
+			metric: m, reason: "second", exit_code: 2, stderr: "bad", ts: time.Now()},
+	}
+	tc <- db_task{kind: DB_TASK_PRUNE_FAILURES, prune_retention_period: time.Hour}
+	stop()
+
+	got, err := db_failures_get(db, time_start, time.Now().Add(time.Minute))
+	assert(t, err == nil, "cannot get failures:", err)
+	fs, ok := got[m.name]
+	assert(t, ok, "missing failures for", m.name)
+	assert(t, fs.count == 2, "unexpected failure count", fs.count)
+	assert(t, fs.latest.reason == "second" && fs.latest.exit_code == 2 && fs.latest.stderr == "bad",
+		"unexpected latest failure", fs.latest)
+	assert(t, failure_format(&fs.latest) == "second (exit code 2): bad",
+		"unexpected formatting", failure_format(&fs.latest))
+}
+
+func TestMeasureReload(t *testing.T) {
+	td := t.TempDir()
+	path_config := filepath.Join(td, "lilmon.ini")
+	db := db_init(db_path_measure(filepath.Join(td, "test.db")))
+	defer db.Close()
+	config := "path_db=/somewhere/db.sqlite\n[metrics]\nmetric=a|A||echo 1\n"
+	err := os.WriteFile(path_config, []byte(config), 0600)
+	assert(t, err == nil, "cannot write config:", err)
+	metrics, err := measure_reload(path_config, db, false)
+	assert(t, err == nil && len(metrics) == 1, "cannot reload:", err)
+
+	// Where pledging is used, scraping over HTTP cannot be added later.
+	config += "metric=s|S||scrape:http://localhost:9100/metrics up\n"
+	err = os.WriteFile(path_config, []byte(config), 0600)
+	assert(t, err == nil, "cannot write config:", err)
+	_, err = measure_reload(path_config, db, false)
+	assert(t, (err == nil) == protect_measure_reloadable(false, true), "unexpected reload error:", err)
+	metrics, err = measure_reload(path_config, db, true)
+	assert(t, err == nil && len(metrics) == 2, "cannot reload with scraping:", err)
+}
+
+func TestServeReload(t *testing.T) {
+	td := t.TempDir()
+	path_config := filepath.Join(td, "lilmon.ini")
+	path_template := filepath.Join(td, "lilmon.template")
+	err := os.WriteFile(path_template, []byte("{{ .Title }}"), 0600)
+	assert(t, err == nil, "cannot write template:", err)
+	config := strings.Replace(test_config, "/somewhere/template", path_template, 1)
+	write_config := func(c string) {
+		err := os.WriteFile(path_config, []byte(c), 0600)
+		assert(t, err == nil, "cannot write config:", err)
+	}
+
+	write_config(config)
+	metrics, sconfig, template, err := serve_load(path_config)
+	assert(t, err == nil, "cannot load:", err)
+	state := &serve_state{}
+	state.set(metrics, sconfig, template)
+
+	// A broken configuration keeps the old state.
+	write_config(config + "metric=broken|Broken|nosuchoption|echo 1\n")
+	serve_reload(path_config, state)
+	got, _, _ := state.get()
+	assert(t, reflect.DeepEqual(got, metrics), "state changed after a failed reload")
+
+	write_config(config + "metric=new|New metric||echo 1\n")
+	serve_reload(path_config, state)
+	got, got_sconfig, _ := state.get()
+	assert(t, len(got) == len(metrics)+1, "unexpected metric count", len(got))
+	assert(t, metric_find(got, "new") != nil, "new metric missing")
+	assert(t, metric_find(got, SELF_PREFIX+"requests") != nil, "self-monitoring metric missing")
+	assert(t, got_sconfig.path_db == sconfig.path_db, "path_db changed", got_sconfig.path_db)
+}
+
+func TestPush(t *testing.T) {
+	metrics := []*metric{{name: "a"}, {name: "b"}}
+	state := &push_state{}
+	state.set(metrics)
+	tc := make(chan db_task, 10)
+	h := push_handler_gen(context.Background(), state, tc, "push")
+	do := func(method, target, body string) int {
+		w := httptest.NewRecorder()
+		h(w, httptest.NewRequest(method, target, strings.NewReader(body)))
+		return w.Code
+	}
+
+	table := []struct {
+		method, target, body string
+		code                 int
+		values               []float64
+	}{
+		{"POST", "/push/a", "1.5\n", http.StatusNoContent, []float64{1.5}},
+		{"POST", "/push/a?ts=1662033600.25", "2", http.StatusNoContent, []float64{2}},
+		{"POST", "/push/a?ts=2022-09-01T12:00:00Z", "3", http.StatusNoContent, []float64{3}},
+		{"POST", "/push/a", "lots", http.StatusBadRequest, nil},
+		{"POST", "/push/a?ts=yesterday", "1", http.StatusBadRequest, nil},
+		{"POST", "/push/c", "1", http.StatusNotFound, nil},
+		{"GET", "/push/a", "", http.StatusMethodNotAllowed, nil},
+		{"POST", "/push", `[{"metric": "a", "value": 4}, {"metric": "b", "value": 5, "ts": 1662033600}]`,
+			http.StatusNoContent, []float64{4, 5}},
+		{"POST", "/push", `[{"metric": "b", "value": 6, "ts": "2022-09-01T12:00:00Z"}, {"metric": "c", "value": 7}]`,
+			http.StatusBadRequest, nil},
+		{"POST", "/push", `[{"metric": "a"}]`, http.StatusBadRequest, nil},
+		{"POST", "/push", `{`, http.StatusBadRequest, nil},
+	}
+	for _, tt := range table {
+		code := do(tt.method, tt.target, tt.body)
+		assertf(t, code == tt.code, "%s %s: wanted %d, got %d", tt.method, tt.target, tt.code, code)
+		for _, want := range tt.values {
+			select {
+			case task := <-tc:
+				assertf(t, almost_equals(task.insert_measurement.value, want),
+					"%s: wanted %f, got %f", tt.target, want, task.insert_measurement.value)
+			default:
+				t.Errorf("%s: missing value %f", tt.target, want)
+			}
+		}
+		assertf(t, len(tc) == 0, "%s: unexpected values: %d", tt.target, len(tc))
+	}
+	ts, err := push_parse_ts("1662033600.25")
+	assert(t, err == nil && ts.Equal(time.Date(2022, 9, 1, 12, 0, 0, 250e6, time.UTC)),
+		"unexpected timestamp", ts, err)
+}
+
+func TestPushMetric(t *testing.T) {
+	td := t.TempDir()
+	mconfig := &config_measure{
+		push_addr: PUSH_UNIX_PREFIX + filepath.Join(td, "push.sock"),
+		path_db:   filepath.Join(td, "test.db"),
+	}
+	m := &metric{name: "pushed"}
+	ts := time.Now()
+
+	// A running measure gets the value.
+	l, err := push_listen(mconfig.push_addr)
+	if err != nil {
+		t.Fatal("cannot listen:", err)
+	}
+	ctx, cf := context.WithCancel(context.Background())
+	state := &push_state{}
+	state.set([]*metric{m})
+	tc := make(chan db_task, 1)
+	done := make(chan struct{})
+	go func() {
+		push_serve(ctx, l, state, tc, time.Second)
+		close(done)
+	}()
+	err = push_metric(mconfig, m, 1.5, ts)
+	assert(t, err == nil, "push failed:", err)
+	task := <-tc
+	assert(t, almost_equals(task.insert_measurement.value, 1.5) && task.insert_measurement.ts.Equal(ts),
+		"unexpected pushed value", task.insert_measurement)
+
+	// A rejected value is not written to the database.
+	err = push_metric(mconfig, &metric{name: "unknown"}, 2, ts)
+	var rejected *push_rejected
+	assert(t, errors.As(err, &rejected), "unknown metric was not rejected:", err)
+	_, err = os.Stat(mconfig.path_db)
+	assert(t, os.IsNotExist(err), "database should not exist:", err)
+	cf()
+	<-done
+
+	// Without measure the value goes directly to the database.
+	err = push_metric(mconfig, m, 3, ts)
+	assert(t, err == nil, "push failed:", err)
+	db := db_init(mconfig.path_db)
+	defer db.Close()
+	dps, err := db_datapoints_get(
+		db, m, true, 1, 10, time.Second, ts.Add(-time.Second), ts.Add(time.Second))
+	assert(t, err == nil, "cannot get datapoints:", err)
+	assert(t, len(dps) == 1 && almost_equals(dps[0].value, 3), "unexpected datapoints", dps)
+
+	// A failed write is reported.
+	bad := &metric{name: "bad"}
+	_, err = db.Exec(fmt.Sprintf(
+		`CREATE TABLE %s (id INTEGER PRIMARY KEY, value REAL CHECK (value < 0), timestamp DATETIME)`,
+		db_table_name_get(bad)))
+	assert(t, err == nil, "cannot create table:", err)
+	err = push_metric(mconfig, bad, 1, ts)
+	assert(t, err != nil, "failed write should be reported")
+}
+
+func TestImport(t *testing.T) {
+	m := &metric{name: "imported"}
+	ts, _ := time.Parse(time.RFC3339, "2022-09-01T12:00:00Z")
+
+	csv_table := []struct {
+		input, ts_format string
+		header           bool
+	}{
+		{"ts,value\n1662033600,1\n1662033600.5,2\n", "auto", true},
+		{"2022-09-01T12:00:00Z, 1\n# comment\n2022-09-01T12:00:00.5Z, 2\n", "rfc3339", false},
+		{"1662033600000,1\n1662033600500,2\n", "unix_ms", false},
+		{"\"2022-09-01 12:00:00\",1\n\"2022-09-01 12:00:00.5\",2\n", "2006-01-02 15:04:05", false},
+	}
+	for _, tt := range csv_table {
+		opts := &import_options{ts_format: tt.ts_format, header: tt.header}
+		if tt.ts_format == "2006-01-02 15:04:05" {
+			// Layouts without a time zone are in local time.
+			ts = time.Date(2022, 9, 1, 12, 0, 0, 0, time.Local)
+		}
+		ms, err := import_read_csv(strings.NewReader(tt.input), m, opts)
+		assertf(t, err == nil, "%q: cannot read: %v", tt.input, err)
+		assertf(t, len(ms) == 2, "%q: unexpected amount of values: %d", tt.input, len(ms))
+		for n, cur := range ms {
+			want := ts.Add(time.Duration(n) * 500 * time.Millisecond)
+			assertf(t, cur.ts.Equal(want) && almost_equals(cur.value, float64(n+1)),
+				"%q: unexpected value %d: %v", tt.input, n, cur)
+		}
+	}
+	_, err := import_read_csv(strings.NewReader("1662033600,lots\n"), m, &import_options{ts_format: "auto"})
+	assert(t, err != nil && strings.Contains(err.Error(), "line 1"), "bad value should fail:", err)
+	_, err = import_read_csv(strings.NewReader("1662033600,1\n,1.5\n"), m, &import_options{ts_format: "auto"})
+	assert(t, err != nil && strings.Contains(err.Error(), "line 2"), "missing timestamp should fail:", err)
+
+	ms, err := import_read_jsonl(strings.NewReader(
+		`{"ts": 1662033600, "value": 1}`+"\n\n"+`{"ts": "2022-09-01T12:00:01Z", "value": 2}`+"\n"),
+		m, &import_options{ts_format: "auto"})
+	assert(t, err == nil, "cannot read JSON Lines:", err)
+	assert(t, len(ms) == 2 && ms[1].ts.Equal(ms[0].ts.Add(time.Second)), "unexpected JSON Lines values", ms)
+	_, err = import_read_jsonl(strings.NewReader(`{"value": 1}`), m, &import_options{ts_format: "auto"})
+	assert(t, err != nil, "missing timestamp should fail")
+
+	db := db_init(filepath.Join(t.TempDir(), "test.db"))
+	defer db.Close()
+	opts := &import_options{skip_duplicates: true, dry_run: true}
+	inserted, skipped, err := import_measurements(db, m, ms, opts)
+	assert(t, err == nil && inserted == 2 && skipped == 0, "unexpected dry run", inserted, skipped, err)
+	exists, err := db_table_exists(db, db_table_name_get(m))
+	assert(t, err == nil && !exists, "dry run should not create tables", err)
+
+	opts.dry_run = false
+	inserted, skipped, err = import_measurements(db, m, ms, opts)
+	assert(t, err == nil && inserted == 2 && skipped == 0, "unexpected import", inserted, skipped, err)
+	// The same values again and a duplicate within the input.
+	ms = append(ms, &measurement{metric: m, value: 3, ts: ms[0].ts.Add(-time.Second)})
+	ms = append(ms, &measurement{metric: m, value: 4, ts: ms[0].ts.Add(-time.Second)})
+	inserted, skipped, err = import_measurements(db, m, ms, opts)
+	assert(t, err == nil && inserted == 1 && skipped == 3, "unexpected import", inserted, skipped, err)
+	dps, err := db_datapoints_get(
+		db, m, true, 1, 10, time.Second, ms[0].ts.Add(-time.Minute), ms[0].ts.Add(time.Minute))
+	assert(t, err == nil && len(dps) == 3, "unexpected datapoints", dps, err)
+
+	// Only the values which were actually written are counted.
+	bad := &metric{name: "bad"}
+	_, err = db.Exec(fmt.Sprintf(
+		`CREATE TABLE %s (id INTEGER PRIMARY KEY, value REAL CHECK (value < 2), timestamp DATETIME)`,
+		db_table_name_get(bad)))
+	assert(t, err == nil, "cannot create table:", err)
+	ms = []*measurement{}
+	for i := 0; i < IMPORT_BATCH_SIZE+1; i++ {
+		value := float64(1)
+		if i == IMPORT_BATCH_SIZE {
+			value = 2
+		}
+		ms = append(ms, &measurement{metric: bad, value: value, ts: ts.Add(time.Duration(i) * time.Second)})
+	}
+	inserted, _, err = import_measurements(db, bad, ms, &import_options{})
+	assert(t, err != nil && inserted == IMPORT_BATCH_SIZE, "unexpected failed import", inserted, err)
+}
+
+func TestExport(t *testing.T) {
+	db := db_init(filepath.Join(t.TempDir(), "test.db"))
+	defer db.Close()
+	m := &metric{name: "exported", description: "Exported\nvalues", options: graph_options{differentiate: true}}
+	err := db_migrate(db, []*metric{m})
+	assert(t, err == nil, "cannot migrate:", err)
+	ts, _ := time.Parse(time.RFC3339, "2022-09-01T12:00:00Z")
+	tc, stop := test_writer(db, DEFAULT_WRITE_BATCH_SIZE, time.Hour)
+	for i := 0; i < 4; i++ {
+		measurement_send(m, float64(10*i), ts.Add(time.Duration(i)*time.Minute), tc)
+	}
+	stop()
+
+	time_start, time_end := ts.Add(-time.Minute), ts.Add(4*time.Minute)
+	raw, err := export_series_get(db, m, time_start, time_end, &export_options{}, 100)
+	assert(t, err == nil && len(raw.values) == 4, "unexpected raw values", raw, err)
+
+	// Binned values are the derivatives per second.
+	opts := &export_options{binned: true, bin_width: time.Minute}
+	binned, err := export_series_get(db, m, time_start, time_end, opts, 100)
+	assert(t, err == nil && len(binned.values) == 5, "unexpected binned values", binned, err)
+	want := []float64{math.NaN(), 10.0 / 60, 10.0 / 60, 10.0 / 60, math.NaN()}
+	for i := range want {
+		if i >= len(binned.values) {
+			break
+		}
+		assertf(t, (math.IsNaN(want[i]) && math.IsNaN(binned.values[i])) || almost_equals(want[i], binned.values[i]),
+			"unexpected binned value %d: %f", i, binned.values[i])
+	}
+
+	b := &bytes.Buffer{}
+	err = export_write(b, "csv", []*export_series{raw})
+	assert(t, err == nil, "csv failed:", err)
+	assert(t, strings.HasPrefix(b.String(), "metric,timestamp,value\nexported,2022-09-01T12:00:00Z,0\n"),
+		"unexpected csv", b.String())
+
+	b.Reset()
+	err = export_write(b, "jsonl", []*export_series{raw})
+	assert(t, err == nil, "jsonl failed:", err)
+	ms, err := import_read_jsonl(b, m, &import_options{ts_format: "auto"})
+	assert(t, err == nil && len(ms) == 4 && ms[3].ts.Equal(raw.times[3]) && almost_equals(ms[3].value, 30),
+		"exported JSON Lines cannot be imported", ms, err)
+
+	b.Reset()
+	err = export_write(b, "openmetrics", []*export_series{binned})
+	assert(t, err == nil, "openmetrics failed:", err)
+	lines := strings.Split(strings.TrimSpace(b.String()), "\n")
+	assert(t, len(lines) == 6, "unexpected openmetrics", b.String())
+	if len(lines) == 6 {
+		assert(t, lines[0] == `# HELP exported Exported\nvalues` && lines[1] == "# TYPE exported gauge",
+			"unexpected openmetrics metadata", lines[:2])
+		assert(t, strings.HasPrefix(lines[2], "exported 0.1666") && strings.HasSuffix(lines[2], " 1662033630"),
+			"unexpected openmetrics sample", lines[2])
+		assert(t, lines[5] == "# EOF", "missing EOF", lines[5])
+	}
+	assert(t, export_write(b, "xml", nil) != nil, "unknown format should fail")
+}
+
+var test_exposition = `# HELP node_network_receive_bytes_total Network device statistic receive_bytes.
+# TYPE node_network_receive_bytes_total counter
+node_network_receive_bytes_total{device="eth0"} 1000
+node_network_receive_bytes_total{device="eth1"} 234 1662033600000
+node_network_receive_bytes_total{device="lo",note="a \"quoted\", value"} 5e3
+node_load1 0.25
+node_uname_info{version="#1 SMP  PREEMPT"} 1
+# EOF
+`
+
+func TestScrape(t *testing.T) {
+	table := []struct {
+		selector string
+		want     float64
+		n        int
+	}{
+		{`node_load1`, 0.25, 1},
+		{`node_network_receive_bytes_total`, 6234, 3},
+		{`node_network_receive_bytes_total{device="eth0"}`, 1000, 1},
+		{`node_network_receive_bytes_total{device!="lo"}`, 1234, 2},
+		{`node_network_receive_bytes_total{device=~"eth.*"}`, 1234, 2},
+		{`node_network_receive_bytes_total{device!~"eth.*"}`, 5000, 1},
+		{`node_network_receive_bytes_total{ note = "a \"quoted\", value" }`, 5000, 1},
+		{`node_network_receive_bytes_total{device="eth"}`, 0, 0},
+		{`node_load`, 0, 0},
+		{`node_uname_info{version="#1 SMP  PREEMPT"}`, 1, 1},
+		{`node_uname_info{version="#1 SMP PREEMPT"}`, 0, 0},
+	}
+	for _, tt := range table {
+		_, sel, err := scrape_parse(SCRAPE_PREFIX + "http://localhost/metrics " + tt.selector)
+		assertf(t, err == nil, "%s: cannot parse: %v", tt.selector, err)
+		if err != nil {
+			continue
+		}
+		got, n := scrape_sum(test_exposition, sel)
+		assertf(t, almost_equals(got, tt.want) && n == tt.n, "%s: unexpected sum %f of %d", tt.selector, got, n)
+	}
+	source, sel, err := scrape_parse(SCRAPE_PREFIX + " /tmp/metrics \t node_load1")
+	assert(t, err == nil && source == "/tmp/metrics" && sel.name == "node_load1",
+		"unexpected source and selector", source, sel, err)
+	for _, bad := range []string{
+		"http://localhost/metrics",
+		`http://localhost/metrics name{device="eth0"`,
+		`http://localhost/metrics name{device=eth0}`,
+		`http://localhost/metrics name{device=~"("}`,
+		`http://localhost/metrics name junk`,
+	} {
+		_, _, err := scrape_parse(SCRAPE_PREFIX + bad)
+		assertf(t, err != nil, "%q should not parse", bad)
+	}
+
+	ctx, cf := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cf()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		fmt.Fprint(w, test_exposition)
+	}))
+	defer srv.Close()
+	path := filepath.Join(t.TempDir(), "metrics.prom")
+	err = os.WriteFile(path, []byte(test_exposition), 0600)
+	assert(t, err == nil, "cannot write exposition:", err)
+	for _, source := range []string{srv.URL, path} {
+		m := &metric{name: "scraped", command: SCRAPE_PREFIX + source + ` node_network_receive_bytes_total{device=~"eth.*"}`}
+		tc := make(chan db_task, 1)
+		failure := exec_metric(ctx, m, "/bin/sh", 1, tc)
+		assertf(t, failure == nil, "%s: scrape failed: %v", source, failure)
+		if failure == nil {
+			result := <-tc
+			assertf(t, almost_equals(result.insert_measurement.value, 1234),
+				"%s: unexpected value %f", source, result.insert_measurement.value)
+		}
+		m.command = SCRAPE_PREFIX + source + " nonexistent"
+		failure = exec_metric(ctx, m, "/bin/sh", 2, tc)
+		assertf(t, failure != nil && strings.HasPrefix(failure.reason, "scrape: no series"),
+			"%s: unexpected failure: %v", source, failure)
+	}
+}
+
+func TestServeMetrics(t *testing.T) {
+	db := db_init(filepath.Join(t.TempDir(), "test.db"))
+	defer db.Close()
+	metrics := []*metric{
+		{name: "temp", description: `Temperature in C:\`},
+		{name: "9lives", description: "Nothing yet"},
+	}
+	err := db_migrate(db, metrics)
+	assert(t, err == nil, "cannot migrate:", err)
+	ts, _ := time.Parse(time.RFC3339, "2022-09-01T12:00:00Z")
+	tc, stop := test_writer(db, DEFAULT_WRITE_BATCH_SIZE, time.Hour)
+	measurement_send(metrics[0], 21.5, ts.Add(250*time.Millisecond), tc)
+	measurement_send(metrics[0], 20, ts, tc)
+	stop()
+
+	state := &serve_state{}
+	state.set(metrics, &config_serve{}, nil)
+	w := httptest.NewRecorder()
+	serve_metrics_gen(db, state, "metrics")(w, httptest.NewRequest("GET", "/metrics", nil))
+	assert(t, w.Code == http.StatusOK, "unexpected status", w.Code)
+	want := `# HELP temp Temperature in C:\\
+# TYPE temp gauge
+temp 21.5 1662033600250
+# HELP _9lives Nothing yet
+# TYPE _9lives gauge
+`
+	assertf(t, w.Body.String() == want, "unexpected exposition:\n%s", w.Body.String())
+}
+
+func TestUnits(t *testing.T) {
+	table := []struct {
+		give, units string
+		want        float64
+	}{
+		{"12.5", UNITS_SI, 12.5},
+		{"-1e3", UNITS_SI, -1000},
+		{"12.5G", UNITS_SI, 12.5e9},
+		{"12.5 GB", UNITS_SI, 12.5e9},
+		{"1.5k", UNITS_SI, 1500},
+		{"2K", UNITS_IEC, 2048},
+		{"512KiB", UNITS_SI, 512 * 1024},
+		{"3Gi", UNITS_SI, 3 * 1024 * 1024 * 1024},
+		{"1.5M", UNITS_IEC, 1.5 * 1024 * 1024},
+		{"100B", UNITS_SI, 100},
+		{"512 B", UNITS_IEC, 512},
+		{"45%", UNITS_SI, 45},
+		{"45.5 %", UNITS_SI, 45.5},
+		{"1.2ms", UNITS_SI, 0.0012},
+		{"1m30s", UNITS_SI, 90},
+		{"3d4h", UNITS_SI, 3*86400 + 4*3600},
+		{"-2w", UNITS_SI, -2 * 7 * 86400},
+		{"3 days, 4:05", UNITS_SI, 3*86400 + 4*3600 + 5*60},
+		{"1 day, 12 min", UNITS_SI, 86400 + 12*60},
+		{"4:05:06", UNITS_SI, 4*3600 + 5*60 + 6},
+		{"7 mins", UNITS_SI, 7 * 60},
+	}
+	for _, tt := range table {
+		got, err := units_parse(tt.give, tt.units)
+		assertf(t, err == nil && almost_equals(got, tt.want),
+			"%q with %s: wanted %f, got %f (%v)", tt.give, tt.units, tt.want, got, err)
+	}
+	for _, bad := range []string{"", "lots", "12X", "G", "days", "%", "B", "12iB"} {
+		_, err := units_parse(bad, UNITS_SI)
+		assertf(t, err != nil, "%q should not parse", bad)
+	}
+
+	_, moptions, errs := config_parse_metric_options("units")
+	assert(t, len(errs) == 0 && moptions.units == UNITS_SI, "unexpected units", moptions.units, errs)
+	_, moptions, errs = config_parse_metric_options("units=IEC")
+	assert(t, len(errs) == 0 && moptions.units == UNITS_IEC, "unexpected units", moptions.units, errs)
+	_, _, errs = config_parse_metric_options("units=metric")
+	assert(t, len(errs) == 1, "bad units should fail")
+
+	ctx, cf := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cf()
+	m := &metric{name: "uptime", command: "echo '3 days,  4:05'", measure: measure_options{units: UNITS_SI}}
+	tc := make(chan db_task, 1)
+	failure := exec_metric(ctx, m, "/bin/sh", 1, tc)
+	assert(t, failure == nil, "units were not parsed:", failure)
+	if failure == nil {
+		result := <-tc
+		assert(t, almost_equals(result.insert_measurement.value, 3*86400+4*3600+5*60),
+			"unexpected value", result.insert_measurement.value)
+	}
+	m.measure.units = ""
+	failure = exec_metric(ctx, m, "/bin/sh", 2, tc)
+	assert(t, failure != nil, "units should not be parsed without the option")
+}
+
+func TestExtract(t *testing.T) {
+	json_out := `{"data": {"items": [{"value": 1.5}, {"value": "2.5", "ok": true}]}}`
+	table := []struct {
+		extractor, out, want string
+	}{
+		{`regex:rtt.*= [0-9.]+/([0-9.]+)/`, "rtt min/avg/max = 1.1/2.2/3.3 ms", "2.2"},
+		{`regex:temp=([0-9]+)C`, "sensor ok\ntemp=45C\n", "45"},
+		{`json:.data.items[0].value`, json_out, "1.5"},
+		{`json:data.items[1].value`, json_out, "2.5"},
+		{`json:.data.items[1].ok`, json_out, "1"},
+		{`key:MemAvailable`, "MemTotal: 100 kB\nMemAvailable:  42 kB\n", "42 kB"},
+		{`key:connections`, "uptime=10\nconnections = 7\n", "7"},
+	}
+	for _, tt := range table {
+		e, err := extractor_parse(tt.extractor)
+		assert(t, err == nil, "cannot parse extractor", tt.extractor, err)
+		if err != nil {
+			continue
+		}
+		got, err := e.extract(tt.out)
+		assertf(t, err == nil && got == tt.want,
+			"%s: wanted %q, got %q (%v)", tt.extractor, tt.want, got, err)
+	}
+	for _, bad := range []string{"regex:[0-9]+", "regex:(", "json:.a[x]", "key:", "awk:{print $1}"} {
+		_, err := extractor_parse(bad)
+		assertf(t, err != nil, "%q should not parse", bad)
+	}
+	for _, tt := range []struct{ extractor, out string }{
+		{"regex:value=([0-9]+)", "value=nope"},
+		{"json:.data.missing", json_out},
+		{"json:.data.items[5]", json_out},
+		{"json:.data", json_out},
+		{"json:.a", "not json"},
+		{"key:nope", "yes=1"},
+	} {
+		e, err := extractor_parse(tt.extractor)
+		assert(t, err == nil, "cannot parse extractor", tt.extractor, err)
+		_, err = e.extract(tt.out)
+		assertf(t, err != nil, "%s should fail for %q", tt.extractor, tt.out)
+	}
+
+	c, err := config_load(strings.NewReader(`path_db=/somewhere/db.sqlite
+[metrics]
+metric=mem|Memory|units=iec|printf 'MemTotal: 100 kB\nMemAvailable: 42 kB\n'
+extract=mem|key:MemAvailable
+`))
+	assert(t, err == nil, "cannot load config:", err)
+	metrics, err := c.parse_metrics()
+	assert(t, err == nil && len(metrics) == 1, "cannot parse metrics:", err)
+	ctx, cf := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cf()
+	tc := make(chan db_task, 1)
+	failure := exec_metric(ctx, metrics[0], "/bin/sh", 1, tc)
+	assert(t, failure == nil, "extraction failed:", failure)
+	if failure == nil {
+		result := <-tc
+		assert(t, almost_equals(result.insert_measurement.value, 42*1024),
+			"unexpected value", result.insert_measurement.value)
+	}
+	metrics[0].measure.extract, _ = extractor_parse("key:MemFree")
+	failure = exec_metric(ctx, metrics[0], "/bin/sh", 2, tc)
+	assert(t, failure != nil && strings.HasPrefix(failure.reason, "extract:"),
+		"missing key should fail", failure)
+
+	for _, bad := range []string{
+		"metric=b|B||builtin:load1\nextract=b|regex:([0-9]+)\n",
+		"metric=m|M||echo a 1\nseries=m|a|A|\nextract=m|key:a\n",
+		"metric=e|E||echo 1\nextract=e|regex:([0-9]+)\nextract=e|key:a\n",
+	} {
+		c, err := config_load(strings.NewReader("path_db=/somewhere/db.sqlite\n[metrics]\n" + bad))
+		assert(t, err == nil, "cannot load config:", err)
+		_, err = c.parse_metrics()
+		assertf(t, err != nil, "config should not parse: %q", bad)
+	}
+}
+
+func TestExecOptions(t *testing.T) {
+	table := []struct {
+		give string
+		want []string
+	}{
+		{"echo one two", []string{"echo", "one", "two"}},
+		{`  printf '%s|%s' "a b"  c\ d `, []string{"printf", "%s|%s", "a b", "c d"}},
+		{`echo '' "it's" '\n'`, []string{"echo", "", "it's", `\n`}},
+	}
+	for _, tt := range table {
+		got, err := argv_split(tt.give)
+		assertf(t, err == nil && reflect.DeepEqual(got, tt.want),
+			"%q: wanted %q, got %q (%v)", tt.give, tt.want, got, err)
+	}
+	for _, bad := range []string{"", "   ", `echo 'one`, `echo "two`, `echo \`} {
+		_, err := argv_split(bad)
+		assertf(t, err != nil, "%q should not split", bad)
+	}
+
+	td := t.TempDir()
+	c, err := config_load(strings.NewReader(`path_db=/somewhere/db.sqlite
+[metrics]
+metric=direct|Direct||printf '%s' "$HOME"
+metric=shelled|Shelled|clean_env|echo $((LILMON_A + LILMON_B))
+metric=dir|Working directory|argv|ls
+metric=input|Input|argv|wc -l
+env=shelled|LILMON_A=1
+env=shelled|LILMON_B=2
+shell=shelled|/bin/sh
+workdir=dir|` + td + `
+stdin=input|first
+stdin=input|second
+`))
+	assert(t, err == nil, "cannot load config:", err)
+	metrics, err := c.parse_metrics()
+	assert(t, err == nil && len(metrics) == 4, "cannot parse metrics:", err)
+	err = os.WriteFile(filepath.Join(td, "12345"), []byte{}, 0600)
+	assert(t, err == nil, "cannot write file:", err)
+
+	ctx, cf := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cf()
+	tc := make(chan db_task, 1)
+	// With argv, "$HOME" is not expanded and the output is not a number.
+	metrics[0].measure.argv = true
+	failure := exec_metric(ctx, metrics[0], "/bin/sh", 1, tc)
+	assert(t, failure != nil && strings.Contains(failure.reason, "$HOME"),
+		"argv should not expand", failure)
+	for n, want := range []float64{3, 12345, 2} {
+		m := metrics[n+1]
+		failure := exec_metric(ctx, m, "/bin/sh", n+2, tc)
+		assert(t, failure == nil, m.name, "failed:", failure)
+		if failure == nil {
+			result := <-tc
+			assert(t, almost_equals(result.insert_measurement.value, want),
+				m.name, "unexpected value", result.insert_measurement.value)
+		}
+	}
+	cmd, err := metric_cmd(metrics[1], "/bin/sh")
+	assert(t, err == nil && reflect.DeepEqual(cmd.Env, []string{"LILMON_A=1", "LILMON_B=2"}),
+		"unexpected environment", cmd.Env, err)
+
+	for _, bad := range []string{
+		"metric=b|B|argv|builtin:load1\n",
+		"metric=q|Q|argv|echo 'one\n",
+		"metric=p|P|clean_env|\n",
+		"metric=s|S||scrape:/somewhere x\nenv=s|A=1\n",
+		"metric=a|A|argv|echo 1\nshell=a|/bin/bash\n",
+		"metric=e|E||echo 1\nenv=e|nothing\n",
+		"metric=w|W||echo 1\nworkdir=w|/tmp\nworkdir=w|/var\n",
+	} {
+		c, err := config_load(strings.NewReader("path_db=/somewhere/db.sqlite\n[metrics]\n" + bad))
+		assert(t, err == nil, "cannot load config:", err)
+		_, err = c.parse_metrics()
+		assertf(t, err != nil, "config should not parse: %q", bad)
+	}
+}
+
+func TestSelfMonitoring(t *testing.T) {
+	c, err := config_load(strings.NewReader(
+		"path_db=/somewhere/db.sqlite\n[metrics]\nmetric=lilmon_mine|Mine||echo 1\n"))
+	assert(t, err == nil, "cannot load config:", err)
+	_, err = c.parse_metrics()
+	assert(t, err != nil, "reserved metric name should not be accepted")
+
+	for _, m := range self_metrics() {
+		assert(t, strings.HasPrefix(m.name, SELF_PREFIX) && is_metric_name_valid(m),
+			"bad self-monitoring metric name", m.name)
+	}
+
+	count := self_metric_new("test_count", "Count", SELF_COUNT, false)
+	mean := self_metric_new("test_mean", "Mean", SELF_MEAN, false)
+	idle := self_metric_new("test_idle", "Idle", SELF_MEAN, false)
+	gauge := self_metric_new("test_gauge", "Gauge", SELF_GAUGE, false)
+	count.observe(1)
+	count.observe(1)
+	mean.observe(1)
+	mean.observe(2)
+	gauges := map[*self_metric]func() (float64, error){
+		gauge: func() (float64, error) { return 42, nil },
+	}
+
+	ctx, cf := context.WithCancel(context.Background())
+	tc := make(chan db_task, 16)
+	done := make(chan struct{})
+	go func() {
+		self_recorder(ctx, tc, []*self_metric{count, mean, idle, gauge}, gauges, 10*time.Millisecond)
+		close(done)
+	}()
+	got := map[string]float64{}
+	for len(got) < 3 {
+		task := <-tc
+		got[task.insert_measurement.metric.name] = task.insert_measurement.value
+	}
+	cf()
+	<-done
+	want := map[string]float64{"lilmon_test_count": 2, "lilmon_test_mean": 1.5, "lilmon_test_gauge": 42}
+	assert(t, reflect.DeepEqual(got, want), "unexpected values", got)
+	// Nothing was observed after the first period.
+	for len(tc) > 0 {
+		task := <-tc
+		m := task.insert_measurement
+		assert(t, m.metric != idle.metric && m.metric != mean.metric, "idle mean recorded")
+		if m.metric == count.metric {
+			assert(t, m.value == 0, "count was not reset", m.value)
+		}
+	}
+
+	size, err := self_file_size(filepath.Join(t.TempDir(), "missing"))
+	assert(t, err == nil && size == 0, "missing file should have zero size", size, err)
+
+	// Without write access, serve does not record anything.
+	db := serve_self_init(db_path_measure(filepath.Join(t.TempDir(), "missing", "test.db")))
+	assert(t, db == nil, "unwritable database should not be used")
+	path_db := filepath.Join(t.TempDir(), "test.db")
+	db = serve_self_init(db_path_measure(path_db))
+	assert(t, db != nil, "writable database should be used")
+	if db != nil {
+		db.Close()
+	}
+	// The tables exist already, so only writing fails.
+	db = serve_self_init(db_path_serve(path_db))
+	assert(t, db == nil, "read-only database should not be used")
+	if os.Geteuid() != 0 {
+		err = os.Chmod(path_db, 0444)
+		assert(t, err == nil, "cannot chmod:", err)
+		db = serve_self_init(db_path_measure(path_db))
+		assert(t, db == nil, "read-only file should not be used")
+	}
+}
+
+func TestMeasureDuration(t *testing.T) {
+	c, err := config_load(strings.NewReader(`path_db=/somewhere/db.sqlite
+[metrics]
+metric=slow|Slow probe|duration|sleep 0.2 && echo 1
+metric=net|Network counters|duration,period=5s|printf 'rx 1\ntx=2\n'
+series=net|rx|Received|
+metric=plain|Plain||echo 1
+`))
+	assert(t, err == nil, "cannot load config:", err)
+	metrics, err := c.parse_metrics()
+	assert(t, err == nil, "cannot parse metrics:", err)
+	names := []string{}
+	for _, m := range metrics {
+		names = append(names, m.name)
+	}
+	want := []string{"slow", "slow_duration", "net", "net_rx", "net_duration", "plain"}
+	assert(t, reflect.DeepEqual(names, want), "unexpected metrics", names)
+	if len(metrics) != len(want) {
+		return
+	}
+	slow := metrics[0]
+	assert(t, slow.duration == metrics[1] && metrics[1].parent == slow, "duration not linked")
+	for _, m := range metrics[2:5] {
+		assertf(t, metric_period(m, time.Minute) == 5*time.Second,
+			"%s should have the period of net, got %s", m.name, metric_period(m, time.Minute))
+	}
+	assert(t, !metric_is_measured(slow.duration) && metric_is_stored(slow.duration),
+		"duration should only be stored")
+
+	ctx, cf := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cf()
+	tc := make(chan db_task, 4)
+	failure := exec_metric(ctx, slow, "/bin/sh", 1, tc)
+	assert(t, failure == nil, "measurement failed:", failure)
+	got := map[*metric]float64{}
+	for len(tc) > 0 {
+		task := <-tc
+		got[task.insert_measurement.metric] = task.insert_measurement.value
+	}
+	assert(t, len(got) == 2 && got[slow] == 1, "unexpected measurements", got)
+	assert(t, got[slow.duration] >= 0.2 && got[slow.duration] < 10,
+		"unexpected duration", got[slow.duration])
+
+	// Failed runs have a duration too.
+	slow.command = "exit 1"
+	failure = exec_metric(ctx, slow, "/bin/sh", 2, tc)
+	assert(t, failure != nil && len(tc) == 1, "failed run should have a duration")
+
+	for _, bad := range []string{
+		"metric=p|Pushed|duration|\n",
+		"metric=a|A|duration|echo 1\nmetric=a_duration|A duration||echo 1\n",
+		"metric=n|N|duration|echo duration 1\nseries=n|duration|D|\n",
+	} {
+		c, err := config_load(strings.NewReader("path_db=/somewhere/db.sqlite\n[metrics]\n" + bad))
+		assert(t, err == nil, "cannot load config:", err)
+		_, err = c.parse_metrics()
+		assertf(t, err != nil, "config should not parse: %q", bad)
+	}
+}
+
+func TestMeasureMultiMetric(t *testing.T) {
+	ctx, cf := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cf()
+	m := &metric{name: "multi", command: `printf 'a 1\nb=2.5\nc three\nd 4\n'`}
+	m.children = []*metric{
+		{name: "multi_a", key: "a", parent: m},
+		{name: "multi_b", key: "b", parent: m},
+		{name: "multi_c", key: "c", parent: m},
+	}
+	tc := make(chan db_task, 10)
+	exec_metric(ctx, m, "/bin/sh", 1, tc)
+	close(tc)
+	got := map[string]float64{}
+	for task := range tc {
+		got[task.insert_measurement.metric.name] = task.insert_measurement.value
+	}
+	want := map[string]float64{"multi_a": 1, "multi_b": 2.5}
+	assert(t, reflect.DeepEqual(got, want), "unexpected values", got)
+}
+
+func TestBuiltins(t *testing.T) {
+	if len(builtins) == 0 {
+		t.Skip("no builtins on this platform")
+	}
+	td := t.TempDir()
+	write := func(path, content string) {
+		path = filepath.Join(td, path)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("proc/loadavg", "0.52 0.58 0.59 1/1164 12345\n")
+	write("proc/meminfo", "MemTotal:  1000 kB\nMemFree:  100 kB\nMemAvailable:  400 kB\n"+
+		"SwapTotal:  50 kB\nSwapFree:  20 kB\n")
+	write("proc/stat", "cpu  100 0 100 800 0 0 0 0 0 0\ncpu0 1 2 3 4 5 6 7 8 9 10\n")
+	write("sys/class/net/eth0/statistics/rx_bytes", "123456\n")
+
+	path_proc_orig, path_sys_orig := path_proc, path_sys
+	path_proc, path_sys = filepath.Join(td, "proc"), filepath.Join(td, "sys")
+	defer func() {
+		path_proc, path_sys = path_proc_orig, path_sys_orig
+	}()
+
+	table := []struct {
+		command string
+		want    float64
+	}{
+		{"builtin:load5", 0.58},
+		{"builtin:mem_total", 1000 * 1024},
+		{"builtin:mem_used", 600 * 1024},
+		{"builtin:swap_used", 30 * 1024},
+		{"builtin:net_rx_bytes:eth0", 123456},
+	}
+	for _, entry := range table {
+		got, err := exec_builtin(context.Background(), &metric{name: "b", command: entry.command})
+		assertf(t, err == nil, "%s: unexpected error: %v", entry.command, err)
+		assertf(t, almost_equals(got, entry.want),
+			"%s: wanted %f, got %f", entry.command, entry.want, got)
+	}
+
+	// The samples are kept between runs of the test.
+	cpu_samples_lock.Lock()
+	delete(cpu_samples, "cpu")
+	cpu_samples_lock.Unlock()
+	m := &metric{name: "cpu", command: "builtin:cpu"}
+	tc := make(chan db_task, 1)
+	failure := exec_metric(context.Background(), m, "/bin/sh", 1, tc)
+	assert(t, failure == nil && len(tc) == 0, "first cpu measurement should produce no value", failure)
+	_, err := exec_builtin(context.Background(), m)
+	assert(t, errors.Is(err, builtin_no_value), "unadvanced cpu counters should produce no value", err)
+	write("proc/stat", "cpu  150 0 150 900 0 0 0 0 0 0\n")
+	// A reloaded metric is a new one with the same name.
+	m = &metric{name: "cpu", command: "builtin:cpu"}
+	got, err := exec_builtin(context.Background(), m)
+	assert(t, err == nil, "unexpected cpu error", err)
+	assert(t, almost_equals(got, 50), "unexpected cpu usage", got)
+
+	got, err = exec_builtin(context.Background(), &metric{name: "fs", command: "builtin:fs_used_pct:" + td})
+	assert(t, err == nil && got >= 0 && got <= 100, "unexpected fs usage", got, err)
+
+	for _, bad := range []string{"builtin:nope", "builtin:fs_used", "builtin:load1:x"} {
+		_, _, err := builtin_parse(bad)
+		assert(t, err != nil, "should fail but did not:", bad)
+	}
+
+	// A hung collector times out and is not started again until it returns.
+	release := make(chan struct{})
+	builtins["test_hang"] = &builtin{collect: func(*metric, string) (float64, error) {
+		<-release
+		return 1, nil
+	}}
+	defer delete(builtins, "test_hang")
+	hang := &metric{name: "hang", command: "builtin:test_hang"}
+	ctx, cf := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cf()
+	failure = exec_metric(ctx, hang, "/bin/sh", 1, make(chan db_task, 1))
+	assert(t, failure != nil && failure.reason == "builtin: timed out", "unexpected failure", failure)
+	_, err = exec_builtin(context.Background(), hang)
+	assert(t, err != nil && err != context.DeadlineExceeded, "hung builtin should not run again", err)
+	close(release)
+	for i := 0; i < 100; i++ {
+		if got, err = exec_builtin(context.Background(), hang); err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert(t, err == nil && got == 1, "returned builtin should run again", got, err)
+}
+
 func TestParseMetricLine(t *testing.T) {
 	badlines := []string{
 		"asd|asd",
@@ -340,11 +1768,19 @@ func TestParseOptions(t *testing.T) {
 			give: "y_min=-10, y_max = 20.5 ",
 			want: graph_options{y_min: &y_min, y_max: &y_max},
 		},
+		{
+			give: "counter,counter_width=64,rate=h",
+			want: graph_options{counter: true, counter_width: 64, rate_unit: time.Hour},
+		},
+		{
+			give: "deriv,rate=MIN",
+			want: graph_options{differentiate: true, rate_unit: time.Minute},
+		},
 	}
 
 	for n, entry := range table {
 		t.Run(fmt.Sprintf("%d_%s", n+1, entry.give), func(t *testing.T) {
-			got, errs := config_parse_metric_options(entry.give)
+			got, _, errs := config_parse_metric_options(entry.give)
 			if len(errs) > 0 {
 				t.Error("should not fail but: ", errs)
 			}
@@ -427,9 +1863,40 @@ func TestParseConfig(t *testing.T) {
 			assertf(t,
 				m.command == `{ echo -n "one"; echo -n two; echo -n three; }|wc -c`,
 				"unexpected %s command: %s", m.name, m.command)
+		case "n_users":
+			got_metrics |= 16
+			assertf(t,
+				m.measure.period == 10*time.Minute,
+				"unexpected %s period: %s", m.name, m.measure.period)
+			assertf(t,
+				metric_period(m, time.Minute) == 10*time.Minute,
+				"unexpected %s effective period", m.name)
+		case "n_cron":
+			got_metrics |= 32
+			assertf(t,
+				m.measure.schedule != nil,
+				"missing %s schedule", m.name)
+		case "net":
+			got_metrics |= 64
+			assertf(t,
+				len(m.children) == 2 && !metric_is_stored(m),
+				"unexpected %s children: %v", m.name, m.children)
+		case "net_rx":
+			got_metrics |= 128
+			assertf(t,
+				m.parent != nil && m.key == "rx" && m.options.kilo,
+				"unexpected %s: %#v", m.name, m)
+			assertf(t,
+				!metric_is_measured(m) && metric_is_stored(m),
+				"unexpected %s measuring", m.name)
+		case "backup_duration":
+			got_metrics |= 256
+			assertf(t,
+				metric_is_push_only(m) && !metric_is_measured(m) && metric_is_stored(m),
+				"unexpected %s push-only status", m.name)
 		}
 	}
-	assert(t, got_metrics == (1+2+4+8), "missing some metrics: ", got_metrics)
+	assert(t, got_metrics == (1+2+4+8+16+32+64+128+256), "missing some metrics: ", got_metrics)
 
 	assert(t,
 		mc.path_db == "/somewhere/db",
@@ -446,6 +1913,21 @@ func TestParseConfig(t *testing.T) {
 	assert(t,
 		mc.shell == "/bin/zsh",
 		"unexpected shell", mc.shell)
+	assert(t,
+		mc.max_concurrent_commands == 3,
+		"unexpected max_concurrent_commands", mc.max_concurrent_commands)
+	assert(t,
+		mc.shutdown_timeout == 5*time.Second,
+		"unexpected shutdown_timeout", mc.shutdown_timeout)
+	assert(t,
+		mc.write_batch_size == 50 && mc.write_batch_delay == 2*time.Second,
+		"unexpected write batching", mc.write_batch_size, mc.write_batch_delay)
+	assert(t,
+		mc.write_queue_size == DEFAULT_WRITE_QUEUE_SIZE,
+		"unexpected write_queue_size", mc.write_queue_size)
+	assert(t,
+		mc.push_addr == "unix:/somewhere/push.sock",
+		"unexpected push_addr", mc.push_addr)
 
 	assert(t,
 		sc.path_db == "/somewhere/db",
@@ -502,6 +1984,100 @@ func TestParseConfig(t *testing.T) {
 		sc.color_bg == color.RGBA{13, 14, 15, 16}, "unexpected color_bg", sc.color_bg)
 }
 
+func TestParseMeasureOptions(t *testing.T) {
+	_, got, errs := config_parse_metric_options(
+		"y_min=0, period=90s,timeout=10s,retries=2,retry_backoff=500ms,splay=5s")
+	assert(t, len(errs) == 0, "should not fail but: ", errs)
+	want := measure_options{
+		period:        90 * time.Second,
+		timeout:       10 * time.Second,
+		retries:       2,
+		retry_backoff: 500 * time.Millisecond,
+		splay:         5 * time.Second,
+	}
+	assert(t, got == want, "unexpected measure options", got)
+
+	for _, bad := range []string{"period=0.5s", "period=soon", "timeout=0s", "retries=-1"} {
+		_, _, errs := config_parse_metric_options(bad)
+		assert(t, len(errs) > 0, "should fail but did not: ", bad)
+	}
+}
+
+func TestCronSchedule(t *testing.T) {
+	at := func(s string) time.Time {
+		ts, err := time.Parse("2006-01-02 15:04", s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ts
+	}
+	table := []struct {
+		expr, from, want string
+	}{
+		{"* * * * *", "2022-09-01 10:00", "2022-09-01 10:01"},
+		{"*/15 * * * *", "2022-09-01 10:07", "2022-09-01 10:15"},
+		{"0 * * * *", "2022-09-01 23:30", "2022-09-02 00:00"},
+		{"30 8-17 * * 1-5", "2022-09-02 17:45", "2022-09-05 08:30"},
+		{"0 0 29 2 *", "2022-03-01 00:00", "2024-02-29 00:00"},
+		{"0,30 12 * * 7", "2022-09-01 00:00", "2022-09-04 12:00"},
+		{"@daily", "2022-12-31 12:00", "2023-01-01 00:00"},
+		{"5/20 * * * *", "2022-09-01 10:30", "2022-09-01 10:45"},
+		{"0 0 */2 * 1", "2026-10-19 00:00", "2026-10-26 00:00"},
+		{"0 0 1 * */3", "2026-10-01 00:00", "2026-11-01 00:00"},
+	}
+	for n, entry := range table {
+		t.Run(fmt.Sprintf("%d_%s", n+1, entry.expr), func(t *testing.T) {
+			s, err := cron_parse(entry.expr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := s.next(at(entry.from))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !got.Equal(at(entry.want)) {
+				t.Errorf("wanted %s, got %s", entry.want, got)
+			}
+		})
+	}
+
+	for _, bad := range []string{"", "* * * *", "60 * * * *", "* * * * * *", "5-1 * * * *", "*/0 * * * *"} {
+		if _, err := cron_parse(bad); err == nil {
+			t.Errorf("should fail but did not: %q", bad)
+		}
+	}
+	s, err := cron_parse("0 0 31 2 *")
+	assert(t, err == nil, "unexpected error", err)
+	_, err = s.next(at("2022-01-01 00:00"))
+	assert(t, err != nil, "impossible schedule should not fire")
+}
+
+func TestMetricNextTick(t *testing.T) {
+	at, _ := time.Parse(time.RFC3339Nano, "2022-09-01T12:03:17.5Z")
+	m := &metric{name: "aligned"}
+	got := metric_next_tick(m, time.Minute, at)
+	want, _ := time.Parse(time.RFC3339, "2022-09-01T12:04:00Z")
+	assert(t, got.Equal(want), "unexpected default tick", got)
+
+	m.measure.period = 15 * time.Minute
+	got = metric_next_tick(m, time.Minute, at)
+	want, _ = time.Parse(time.RFC3339, "2022-09-01T12:15:00Z")
+	assert(t, got.Equal(want), "unexpected period tick", got)
+	// Ticks are strictly after the given time.
+	got = metric_next_tick(m, time.Minute, want)
+	want, _ = time.Parse(time.RFC3339, "2022-09-01T12:30:00Z")
+	assert(t, got.Equal(want), "unexpected following tick", got)
+
+	m.measure.splay = 10 * time.Second
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 100; i++ {
+		splay := metric_splay(m, time.Minute, r)
+		assert(t, splay >= 0 && splay < m.measure.splay, "splay out of range", splay)
+	}
+	m.measure.splay = 0
+	assert(t, metric_splay(m, time.Minute, r) == 0, "unexpected splay")
+}
+
 func TestParseRGBA(t *testing.T) {
 	got, err := parse_rgba("1,2,3,  4 ")
 	want := color.RGBA{R: 1, G: 2, B: 3, A: 4}
@@ -33,7 +33,7 @@ func main() {
 
 	if len(os.Args) <= 1 {
 		fmt.Printf("usage: %s [subcommand]\n", filepath.Base(os.Args[0]))
-		fmt.Println("subcommand is either `measure', `serve', or `help'`.")
+		fmt.Println("subcommand is either `measure', `serve', `push', `import', `export', or `help'`.")
 		os.Exit(1)
 	}
 
@@ -43,6 +43,47 @@ func main() {
 	cmd_serve := flag.NewFlagSet("serve", flag.ExitOnError)
 	cmd_serve.StringVar(&path_config, FLAG_CONFIG_PATH, DEFAULT_CONFIG_PATH, HELP_CONFIG_PATH)
 
+	var push_ts string
+	cmd_push := flag.NewFlagSet("push", flag.ExitOnError)
+	cmd_push.StringVar(&path_config, FLAG_CONFIG_PATH, DEFAULT_CONFIG_PATH, HELP_CONFIG_PATH)
+	cmd_push.StringVar(&push_ts, FLAG_PUSH_TS, "", HELP_PUSH_TS)
+	cmd_push.Usage = func() {
+		fmt.Fprintf(cmd_push.Output(), "usage: %s push [flags] <metric> <value>\n", filepath.Base(os.Args[0]))
+		cmd_push.PrintDefaults()
+	}
+
+	import_opts := &import_options{}
+	cmd_import := flag.NewFlagSet("import", flag.ExitOnError)
+	cmd_import.StringVar(&path_config, FLAG_CONFIG_PATH, DEFAULT_CONFIG_PATH, HELP_CONFIG_PATH)
+	cmd_import.StringVar(&import_opts.format, "format", "csv", "Input format: csv or jsonl")
+	cmd_import.StringVar(&import_opts.ts_format, "ts-format", "auto",
+		"Timestamp format: auto, unix, unix_ms, rfc3339, or a Go time layout")
+	cmd_import.BoolVar(&import_opts.header, "header", false, "Skip the first line of CSV input")
+	cmd_import.BoolVar(&import_opts.skip_duplicates, "skip-duplicates", false,
+		"Skip values with a timestamp which the metric already has")
+	cmd_import.BoolVar(&import_opts.dry_run, "dry-run", false, "Read the values but do not write them")
+	cmd_import.Usage = func() {
+		fmt.Fprintf(cmd_import.Output(), "usage: %s import [flags] <metric> [file]\n", filepath.Base(os.Args[0]))
+		cmd_import.PrintDefaults()
+	}
+
+	export_opts := &export_options{}
+	cmd_export := flag.NewFlagSet("export", flag.ExitOnError)
+	cmd_export.StringVar(&path_config, FLAG_CONFIG_PATH, DEFAULT_CONFIG_PATH, HELP_CONFIG_PATH)
+	cmd_export.StringVar(&export_opts.format, "format", "csv", "Output format: csv, jsonl, or openmetrics")
+	cmd_export.StringVar(&export_opts.raw_start, "start", "",
+		"Start as Unix seconds, RFC3339, or a duration ago, default is the graphs' default period")
+	cmd_export.StringVar(&export_opts.raw_end, "end", "now",
+		"End as Unix seconds, RFC3339, or a duration ago")
+	cmd_export.BoolVar(&export_opts.binned, "binned", false,
+		"Bin and process the values like the graphs do")
+	cmd_export.DurationVar(&export_opts.bin_width, "bin-width", 0,
+		"Bin width with -binned, default is bin_width of the serve configuration")
+	cmd_export.Usage = func() {
+		fmt.Fprintf(cmd_export.Output(), "usage: %s export [flags] <metric>...\n", filepath.Base(os.Args[0]))
+		cmd_export.PrintDefaults()
+	}
+
 	switch os.Args[1] {
 	case "measure":
 		cmd_measure.Parse(os.Args[2:])
@@ -52,11 +93,42 @@ func main() {
 		cmd_serve.Parse(os.Args[2:])
 		make_sure_not_root()
 		serve(path_config)
+	case "push":
+		cmd_push.Parse(os.Args[2:])
+		if cmd_push.NArg() != 2 {
+			cmd_push.Usage()
+			os.Exit(1)
+		}
+		make_sure_not_root()
+		push(path_config, cmd_push.Arg(0), cmd_push.Arg(1), push_ts)
+	case "import":
+		cmd_import.Parse(os.Args[2:])
+		if cmd_import.NArg() < 1 || cmd_import.NArg() > 2 {
+			cmd_import.Usage()
+			os.Exit(1)
+		}
+		path_input := "-"
+		if cmd_import.NArg() == 2 {
+			path_input = cmd_import.Arg(1)
+		}
+		make_sure_not_root()
+		import_values(path_config, cmd_import.Arg(0), path_input, import_opts)
+	case "export":
+		cmd_export.Parse(os.Args[2:])
+		if cmd_export.NArg() < 1 {
+			cmd_export.Usage()
+			os.Exit(1)
+		}
+		make_sure_not_root()
+		export(path_config, cmd_export.Args(), export_opts)
 	case "help":
 		fmt.Println("The subcommands are:")
 		fmt.Println()
 		fmt.Println("    measure          measure metrics until interrupted")
 		fmt.Println("    serve            display measurements via HTTP")
+		fmt.Println("    push             record a value for a metric")
+		fmt.Println("    import           import historical values from CSV or JSON Lines")
+		fmt.Println("    export           export values as CSV, JSON Lines, or OpenMetrics")
 		fmt.Println("    help             show this help")
 		fmt.Println()
 		os.Exit(0)
@@ -2,12 +2,44 @@ package main
 
 import (
 	"context"
-	"fmt"
+	"database/sql"
+	"errors"
 	"log"
+	"net"
 	"os"
 	"os/signal"
+	"sync"
+	"syscall"
 )
 
+// measure_reload reads the metrics again from the configuration file and
+// creates tables for any new metrics. Scraping over HTTP must have been
+// configured at start for it to be added.
+func measure_reload(path_config string, db *sql.DB, scrape_pledged bool) ([]*metric, error) {
+	config, err := config_load_file(path_config)
+	if err != nil {
+		return nil, err
+	}
+	metrics, err := config.parse_metrics()
+	if err != nil {
+		return nil, err
+	}
+	scrape := len(metrics_filter(metrics, metric_is_scrape_http)) > 0
+	if !protect_measure_reloadable(scrape_pledged, scrape) {
+		return nil, errors.New("scraping over HTTP requires restarting measure")
+	}
+	if err := db_migrate(db, metrics_filter(metrics, metric_is_stored)); err != nil {
+		return nil, err
+	}
+	return metrics, nil
+}
+
+// measure_pruned returns the metrics whose tables are pruned. This includes
+// the self-monitoring metrics of both `measure` and `serve`.
+func measure_pruned(metrics []*metric) []*metric {
+	return append(metrics_filter(metrics, metric_is_stored), self_metrics()...)
+}
+
 func measure(path_config string) {
 	config, err := config_load_file(path_config)
 	if err != nil {
@@ -32,11 +64,23 @@ func measure(path_config string) {
 	if err != nil {
 		log.Fatal("config file reading failed, cannot proceed with measure: ", err)
 	}
-	if err := db_migrate(db, metrics); err != nil {
+	stored := metrics_filter(metrics, metric_is_stored)
+	if err := db_migrate(db, measure_pruned(metrics)); err != nil {
 		log.Fatal("cannot proceed with measure: ", err)
 	}
 
-	if err := protect_measure(); err != nil {
+	var push_listener net.Listener
+	if mconfig.push_addr != "" {
+		push_listener, err = push_listen(mconfig.push_addr)
+		if err != nil {
+			log.Fatal("cannot listen for pushed values: ", err)
+		}
+	}
+
+	// Pledging cannot be relaxed later, so scraping over HTTP has to be
+	// configured when we start.
+	scrape := len(metrics_filter(metrics, metric_is_scrape_http)) > 0
+	if err := protect_measure(push_listener != nil, scrape); err != nil {
 		log.Fatal("protect: ", err)
 	}
 
@@ -45,16 +89,83 @@ func measure(path_config string) {
 	ctx, cf := context.WithCancel(context.Background())
 
 	ci := make(chan os.Signal, 1)
-	signal.Notify(ci, os.Interrupt)
+	signal.Notify(ci, os.Interrupt, syscall.SIGTERM)
 	go func() {
-		for range ci {
-			cf()
-			fmt.Println("got SIGINT -- bailing")
+		sig := <-ci
+		log.Printf("got %s -- stopping, send again to exit immediately\n", sig)
+		cf()
+		sig = <-ci
+		log.Printf("got %s again -- exiting\n", sig)
+		os.Exit(1)
+	}()
+
+	push := &push_state{}
+	push.set(stored)
+
+	reload_run := make(chan []*metric)
+	reload_prune := make(chan []*metric)
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGHUP)
+	go func() {
+		for range ch {
+			log.Println("got SIGHUP -- reloading metrics from ", path_config)
+			metrics, err := measure_reload(path_config, db, scrape)
+			if err != nil {
+				log.Println("reloading failed, keeping old metrics: ", err)
+				continue
+			}
+			push.set(metrics_filter(metrics, metric_is_stored))
+			for _, r := range []struct {
+				ch      chan<- []*metric
+				metrics []*metric
+			}{
+				{reload_run, metrics_filter(metrics, metric_is_measured)},
+				{reload_prune, measure_pruned(metrics)},
+			} {
+				select {
+				case r.ch <- r.metrics:
+				case <-ctx.Done():
+					return
+				}
+			}
 		}
 	}()
 
-	ct := make(chan db_task)
-	go db_writer(ctx, db, ct)
-	go db_pruner(ctx, ct, metrics, mconfig.retention_time, mconfig.prune_db_period)
-	run_metrics(ctx, db, mconfig.measure_period, mconfig.shell, metrics, ct)
+	// The writer is not cancelled with ctx. Instead, it stops after
+	// everyone sending to it has stopped and the channel is closed.
+	ct := make(chan db_task, mconfig.write_queue_size)
+	writer_done := make(chan struct{})
+	go func() {
+		db_writer(context.Background(), db, ct, mconfig.write_batch_size, mconfig.write_batch_delay)
+		close(writer_done)
+	}()
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		db_pruner(ctx, ct, measure_pruned(metrics), reload_prune,
+			mconfig.retention_time, mconfig.prune_db_period)
+	}()
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		gauges := map[*self_metric]func() (float64, error){
+			self_write_queue: func() (float64, error) { return float64(len(ct)), nil },
+			self_db_size:     func() (float64, error) { return self_file_size(mconfig.path_db) },
+			self_wal_size:    func() (float64, error) { return self_file_size(mconfig.path_db + "-wal") },
+		}
+		self_recorder(ctx, ct, self_metrics_measure, gauges, mconfig.measure_period)
+	}()
+	if push_listener != nil {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			push_serve(ctx, push_listener, push, ct, mconfig.shutdown_timeout)
+		}()
+	}
+	run_metrics(ctx, db, mconfig, metrics_filter(metrics, metric_is_measured), reload_run, ct)
+	wg.Wait()
+	close(ct)
+	<-writer_done
+	log.Println("All measurements written, closing database")
 }
@@ -1,65 +1,602 @@
 package main
 
 import (
+	"bytes"
 	"context"
 	"database/sql"
 	"errors"
 	"fmt"
 	"log"
+	"math/rand"
+	"os"
 	"os/exec"
-	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 )
 
-func exec_metric(ctx context.Context, m *metric, shell string, ord int, tasks chan<- db_task) {
-	cmd := exec.CommandContext(ctx, shell, "-c", m.command)
-	out, err := cmd.Output()
+func measurement_send(m *metric, val float64, ts time.Time, tasks chan<- db_task) {
+	tasks <- db_task{
+		kind: DB_TASK_INSERT,
+		insert_measurement: &measurement{
+			metric: m,
+			value:  val,
+			ts:     ts,
+		}}
+}
+
+// parse_multi_values reads lines of `name value` or `name=value` pairs.
+func parse_multi_values(m *metric, out string) ([]string, []float64, []error) {
+	keys := []string{}
+	vals := []float64{}
+	errs := []error{}
+	for n, line := range strings.Split(out, "\n") {
+		line = strings.TrimSpace(line)
+		if len(line) == 0 {
+			continue
+		}
+		var split []string
+		if strings.Contains(line, "=") {
+			split = strings.SplitN(line, "=", 2)
+		} else {
+			// Values with units may contain spaces.
+			split = strings.Fields(line)
+			if len(split) > 2 && m.measure.units != "" {
+				split = []string{split[0], strings.Join(split[1:], " ")}
+			}
+		}
+		if len(split) != 2 {
+			errs = append(errs, fmt.Errorf("line %d: not a name-value pair: %q", n+1, line))
+			continue
+		}
+		val, err := metric_parse_value(m, strings.TrimSpace(split[1]))
+		if err != nil {
+			errs = append(errs, fmt.Errorf("line %d: %w", n+1, err))
+			continue
+		}
+		keys = append(keys, strings.TrimSpace(split[0]))
+		vals = append(vals, val)
+	}
+	return keys, vals, errs
+}
+
+func exec_multi_metric(m *metric, out string, ts time.Time, ord int,
+	tasks chan<- db_task) *measurement_failure {
+
+	keys, vals, errs := parse_multi_values(m, out)
+	for _, err := range errs {
+		log.Printf("{%d}... skipping output: %v\n", ord, err)
+	}
+	sent := 0
+	for n, key := range keys {
+		var child *metric
+		for _, cur := range m.children {
+			if cur.key == key {
+				child = cur
+				break
+			}
+		}
+		if child == nil {
+			log.Printf("{%d}... ignoring undeclared series %q\n", ord, key)
+			continue
+		}
+		measurement_send(child, vals[n], ts, tasks)
+		sent++
+	}
+	if sent == 0 {
+		return &measurement_failure{
+			metric:    m,
+			reason:    fmt.Sprintf("no declared series in output: %q", truncate(out, 64)),
+			exit_code: 0,
+			ts:        ts,
+		}
+	}
+	return nil
+}
+
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	return s[:n] + "..."
+}
+
+// truncating_buffer keeps only the beginning of what is written to it.
+type truncating_buffer struct {
+	bytes.Buffer
+	limit int
+}
+
+func (b *truncating_buffer) Write(p []byte) (int, error) {
+	if room := b.limit - b.Len(); room > 0 {
+		if len(p) > room {
+			b.Buffer.Write(p[:room])
+		} else {
+			b.Buffer.Write(p)
+		}
+	}
+	return len(p), nil
+}
+
+// exec_command runs the command in its own process group. When the context
+// is done, the whole group is killed. Otherwise a hung grandchild could keep
+// stdout open, and we would wait for it indefinitely.
+func exec_command(ctx context.Context, cmd *exec.Cmd) ([]byte, []byte, error) {
+	stdout := bytes.Buffer{}
+	stderr := truncating_buffer{limit: MAX_FAILURE_STDERR}
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	if err := cmd.Start(); err != nil {
+		return nil, nil, err
+	}
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+		case <-done:
+		}
+	}()
+	err := cmd.Wait()
+	close(done)
+	if err != nil && ctx.Err() != nil {
+		err = fmt.Errorf("%w: %v", ctx.Err(), err)
+	}
+	return stdout.Bytes(), stderr.Bytes(), err
+}
+
+// argv_split splits the command into words. Words may be quoted with single
+// or double quotes, and a backslash escapes the next character outside single
+// quotes. Nothing else is expanded.
+func argv_split(command string) ([]string, error) {
+	ret := []string{}
+	cur := strings.Builder{}
+	in_word := false
+	var quote rune
+	escaped := false
+	for _, c := range command {
+		switch {
+		case escaped:
+			cur.WriteRune(c)
+			escaped = false
+		case c == '\\' && quote != '\'':
+			escaped = true
+			in_word = true
+		case quote != 0 && c == quote:
+			quote = 0
+		case quote != 0:
+			cur.WriteRune(c)
+		case c == '\'' || c == '"':
+			quote = c
+			in_word = true
+		case c == ' ' || c == '\t' || c == '\n':
+			if in_word {
+				ret = append(ret, cur.String())
+				cur.Reset()
+				in_word = false
+			}
+		default:
+			cur.WriteRune(c)
+			in_word = true
+		}
+	}
+	if quote != 0 || escaped {
+		return nil, errors.New("unterminated quote or escape in command")
+	}
+	if in_word {
+		ret = append(ret, cur.String())
+	}
+	if len(ret) == 0 {
+		return nil, errors.New("empty command")
+	}
+	return ret, nil
+}
+
+// metric_cmd prepares the command of the metric. Unless the metric is run
+// with argv, the command is given to the shell.
+func metric_cmd(m *metric, shell string) (*exec.Cmd, error) {
+	var cmd *exec.Cmd
+	if m.measure.argv {
+		argv, err := argv_split(m.command)
+		if err != nil {
+			return nil, err
+		}
+		cmd = exec.Command(argv[0], argv[1:]...)
+	} else {
+		if m.measure.exec != nil && m.measure.exec.shell != "" {
+			shell = m.measure.exec.shell
+		}
+		cmd = exec.Command(shell, "-c", m.command)
+	}
+	env := []string{}
+	if !m.measure.clean_env {
+		env = os.Environ()
+	}
+	if e := m.measure.exec; e != nil {
+		// Later values win, so the metric's own variables override ours.
+		env = append(env, e.env...)
+		cmd.Dir = e.workdir
+		if e.stdin != nil {
+			cmd.Stdin = strings.NewReader(*e.stdin)
+		}
+	}
+	cmd.Env = env
+	return cmd, nil
+}
+
+func exec_failure(m *metric, err error, stderr []byte, ts time.Time) *measurement_failure {
+	f := &measurement_failure{
+		metric:    m,
+		reason:    err.Error(),
+		exit_code: -1,
+		stderr:    string(stderr),
+		ts:        ts,
+	}
+	var exit_err *exec.ExitError
+	switch {
+	case errors.Is(err, context.DeadlineExceeded):
+		f.reason = "timed out"
+	case errors.As(err, &exit_err):
+		f.exit_code = exit_err.ExitCode()
+	}
+	return f
+}
+
+func exec_metric(ctx context.Context, m *metric, shell string, ord int,
+	tasks chan<- db_task) *measurement_failure {
+
+	// The measurement is considered to be taken when the command starts.
+	ts := time.Now()
+	if m.duration != nil {
+		// Also failed runs are recorded, because a timed out command is
+		// exactly what we want to see.
+		defer func() {
+			measurement_send(m.duration, time.Since(ts).Seconds(), ts, tasks)
+		}()
+	}
+	if metric_is_builtin(m) {
+		val, err := exec_builtin(ctx, m)
+		if errors.Is(err, builtin_no_value) {
+			log.Printf("{%d}... builtin has no value yet\n", ord)
+			return nil
+		}
+		if err != nil {
+			log.Printf(
+				"{%d}... builtin failed: %v\n",
+				ord, err)
+			f := exec_failure(m, err, nil, ts)
+			f.reason = "builtin: " + f.reason
+			return f
+		}
+		log.Printf(
+			"{%d}... builtin worked and returned: %f\n",
+			ord, val)
+		measurement_send(m, val, ts, tasks)
+		return nil
+	}
+	if metric_is_scrape(m) {
+		val, err := exec_scrape(ctx, m)
+		if err != nil {
+			log.Printf(
+				"{%d}... scrape failed: %v\n",
+				ord, err)
+			return &measurement_failure{
+				metric:    m,
+				reason:    "scrape: " + err.Error(),
+				exit_code: -1,
+				ts:        ts,
+			}
+		}
+		log.Printf(
+			"{%d}... scrape worked and returned: %f\n",
+			ord, val)
+		measurement_send(m, val, ts, tasks)
+		return nil
+	}
+	cmd, err := metric_cmd(m, shell)
+	if err != nil {
+		log.Printf(
+			"{%d}... cannot run: %v\n",
+			ord, err)
+		return exec_failure(m, err, nil, ts)
+	}
+	out, stderr, err := exec_command(ctx, cmd)
 	if err != nil {
 		log.Printf(
 			"{%d}... run failed: %v\n",
 			ord, err)
-		return
+		return exec_failure(m, err, stderr, ts)
+	}
+	if len(m.children) > 0 {
+		log.Printf("{%d}... run worked and returned %d bytes\n", ord, len(out))
+		return exec_multi_metric(m, string(out), ts, ord, tasks)
 	}
 	cleaned := strings.TrimSpace(string(out))
 	log.Printf(
 		"{%d}... run worked and returned: %q\n",
 		ord, cleaned)
+	if m.measure.extract != nil {
+		extracted, err := m.measure.extract.extract(cleaned)
+		if err != nil {
+			log.Printf(
+				"{%d}... but extracting the value failed: %v, output: %q\n",
+				ord, err, truncate(cleaned, 256))
+			return &measurement_failure{
+				metric:    m,
+				reason:    fmt.Sprintf("extract: %v", err),
+				exit_code: 0,
+				stderr:    string(stderr),
+				ts:        ts,
+			}
+		}
+		cleaned = extracted
+	}
 
-	val, err := strconv.ParseFloat(cleaned, 64)
+	val, err := metric_parse_value(m, cleaned)
 	if err != nil {
 		log.Printf(
 			"{%d}... but it's not floaty: %v\n",
 			ord, err)
-		return
+		return &measurement_failure{
+			metric:    m,
+			reason:    fmt.Sprintf("not a number: %q", truncate(cleaned, 64)),
+			exit_code: 0,
+			stderr:    string(stderr),
+			ts:        ts,
+		}
 	}
 
-	tasks <- db_task{
-		kind: DB_TASK_INSERT,
-		insert_measurement: &measurement{
-			metric: m,
-			value:  val,
-		}}
+	measurement_send(m, val, ts, tasks)
+	return nil
+}
+
+// exec_metric_retrying runs the metric with a timeout for each attempt. Failed
+// attempts are retried with an exponential backoff. If all attempts fail, the
+// last failure is recorded.
+func exec_metric_retrying(ctx context.Context, m *metric, shell string, ord int,
+	timeout time.Duration, tasks chan<- db_task) {
+
+	backoff := m.measure.retry_backoff
+	if backoff == 0 {
+		backoff = DEFAULT_RETRY_BACKOFF
+	}
+	for attempt := 0; ; attempt++ {
+		actx, cf := context.WithTimeout(ctx, timeout)
+		failure := exec_metric(actx, m, shell, ord, tasks)
+		cf()
+		self_commands_run.observe(1)
+		if failure != nil {
+			self_commands_failed.observe(1)
+		}
+		if failure == nil || ctx.Err() != nil {
+			return
+		}
+		if attempt >= m.measure.retries {
+			tasks <- db_task{
+				kind:           DB_TASK_FAILURE,
+				insert_failure: failure,
+			}
+			return
+		}
+		log.Printf(
+			"{%d}... retry %d/%d in %s\n",
+			ord, attempt+1, m.measure.retries, backoff)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+// metric_period returns the typical time between two measurements of a
+// metric. For cron-scheduled metrics this is only an estimate. Series and run
+// times are measured with their parent.
+func metric_period(m *metric, default_period time.Duration) time.Duration {
+	if m.parent != nil {
+		return metric_period(m.parent, default_period)
+	}
+	switch {
+	case m.measure.period > 0:
+		return m.measure.period
+	case m.measure.schedule != nil:
+		now := time.Now()
+		first, err_first := m.measure.schedule.next(now)
+		second, err_second := m.measure.schedule.next(first)
+		if err_first == nil && err_second == nil {
+			return second.Sub(first)
+		}
+	}
+	return default_period
+}
+
+// metric_next_tick returns the first scheduled time strictly after the given
+// time. Periodic metrics are aligned to multiples of their period since the
+// Unix epoch, so all hosts measure on the same wall clock boundaries.
+func metric_next_tick(m *metric, default_period time.Duration, after time.Time) time.Time {
+	if m.measure.schedule != nil {
+		next, err := m.measure.schedule.next(after)
+		if err == nil {
+			return next
+		}
+		log.Printf("%s: cannot schedule: %v\n", m.name, err)
+	}
+	period := int64(metric_period(m, default_period))
+	ns := after.UnixNano()
+	return time.Unix(0, ns-ns%period+period)
+}
+
+// metric_splay returns a random delay for a single run so that commands of
+// the same tick are not all started at once.
+func metric_splay(m *metric, default_period time.Duration, r *rand.Rand) time.Duration {
+	splay := m.measure.splay
+	if period := metric_period(m, default_period); splay > period {
+		splay = period
+	}
+	if splay <= 0 {
+		return 0
+	}
+	return time.Duration(r.Int63n(int64(splay)))
+}
+
+func metric_timeout(m *metric, default_period time.Duration) time.Duration {
+	if m.measure.timeout > 0 {
+		return m.measure.timeout
+	}
+	return metric_period(m, default_period)/2 + 1
 }
 
-func run_metrics(ctx context.Context, db *sql.DB, period time.Duration, shell string,
-	metrics []*metric, tasks chan<- db_task) {
+// measure_worker runs jobs until the channel is closed. Jobs still in the
+// queue after scheduling has stopped are dropped. Running commands are only
+// cancelled via exec_ctx.
+func measure_worker(ctx, exec_ctx context.Context, shell string,
+	jobs <-chan measure_job, tasks chan<- db_task, wg *sync.WaitGroup) {
 
-	log.Println("Entering measurement loop with period of ", period, "...")
+	defer wg.Done()
+	for job := range jobs {
+		if ctx.Err() == nil {
+			exec_metric_retrying(exec_ctx, job.metric, shell, job.ord, job.timeout, tasks)
+		} else {
+			log.Printf("{%d} Dropping queued command: %q\n", job.ord, job.metric.command)
+		}
+		atomic.StoreInt32(job.busy, 0)
+	}
+}
+
+// measure_workers_stop waits for the running commands to finish for at most
+// timeout after which they are cancelled.
+func measure_workers_stop(jobs chan measure_job, wg *sync.WaitGroup,
+	exec_cf context.CancelFunc, timeout time.Duration) {
+
+	close(jobs)
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	log.Println("Waiting", timeout, "for running commands to finish")
+	select {
+	case <-done:
+		log.Println("All commands finished")
+		return
+	case <-time.After(timeout):
+	}
+	log.Println("Cancelling commands which are still running")
+	exec_cf()
+	<-done
+}
+
+func run_metrics(ctx context.Context, db *sql.DB, mconfig *config_measure,
+	metrics []*metric, reload <-chan []*metric, tasks chan<- db_task) {
+
+	period := mconfig.measure_period
+	log.Println("Entering measurement loop with default period of ", period, "...")
+	// Commands are run by a fixed amount of workers. A metric is not queued
+	// again while its previous run is still queued or running.
+	log.Println("Starting", mconfig.max_concurrent_commands, "measurement workers")
+	jobs := make(chan measure_job, len(metrics)+mconfig.max_concurrent_commands)
+	// Commands outlive ctx so that they may finish when we are stopping.
+	exec_ctx, exec_cf := context.WithCancel(context.Background())
+	defer exec_cf()
+	var wg sync.WaitGroup
+	for i := 0; i < mconfig.max_concurrent_commands; i++ {
+		wg.Add(1)
+		go measure_worker(ctx, exec_ctx, mconfig.shell, jobs, tasks, &wg)
+	}
+	// The busy flags are kept by name so that they survive reloading.
+	busy := map[string]*int32{}
+
+	// Each metric is tracked with its own tick, which is the aligned time
+	// it is scheduled for. The metric is due after the tick and its splay.
+	r := rand.New(rand.NewSource(time.Now().UnixNano()))
+	var tick, due []time.Time
+	schedule := func() {
+		now := time.Now()
+		tick = make([]time.Time, len(metrics))
+		due = make([]time.Time, len(metrics))
+		for n, m := range metrics {
+			if _, ok := busy[m.name]; !ok {
+				busy[m.name] = new(int32)
+			}
+			tick[n] = metric_next_tick(m, period, now)
+			due[n] = tick[n].Add(metric_splay(m, period, r))
+			log.Printf("Metric %s first due at %s\n", m.name, due[n])
+		}
+	}
+	schedule()
 	ord := 0
 	for {
+		// With no metrics, we just wait for a reload.
+		var wakeup <-chan time.Time
+		if len(due) > 0 {
+			earliest := due[0]
+			for _, t := range due[1:] {
+				if t.Before(earliest) {
+					earliest = t
+				}
+			}
+			wakeup = time.After(time.Until(earliest))
+		}
 		select {
 		case <-ctx.Done():
+			log.Println("Measurement loop stopped")
+			measure_workers_stop(jobs, &wg, exec_cf, mconfig.shutdown_timeout)
 			return
-		case <-time.After(period):
+		case metrics = <-reload:
+			log.Println("Measurement loop reloaded with", len(metrics), "metrics")
+			schedule()
+		case <-wakeup:
+			now := time.Now()
 			for n, m := range metrics {
+				if now.Before(due[n]) {
+					continue
+				}
 				ord++
-				sctx, cf := context.WithTimeout(ctx, period/2+1)
-				defer cf()
-				log.Printf(
-					"{%d} Running command %d/%d: %q\n",
-					ord, n+1, len(metrics), m.command)
-				go exec_metric(sctx, m, shell, ord, tasks)
+				// Scheduling from the previous tick instead of the
+				// current time avoids drift. If we were late enough
+				// to pass more ticks, they are skipped.
+				next := metric_next_tick(m, period, tick[n])
+				missed := 0
+				for !next.After(now) {
+					missed++
+					next = metric_next_tick(m, period, next)
+				}
+				if missed > 0 {
+					log.Printf(
+						"{%d} Metric %s missed %d tick(s), was due at %s\n",
+						ord, m.name, missed, due[n])
+				}
+				tick[n] = next
+				due[n] = next.Add(metric_splay(m, period, r))
+				if !atomic.CompareAndSwapInt32(busy[m.name], 0, 1) {
+					log.Printf(
+						"{%d} Skipping command %d/%d, previous run still active: %q\n",
+						ord, n+1, len(metrics), m.command)
+					continue
+				}
+				job := measure_job{
+					metric:  m,
+					ord:     ord,
+					timeout: metric_timeout(m, period),
+					busy:    busy[m.name],
+				}
+				// After a reload there may be more metrics than
+				// the queue was sized for.
+				select {
+				case jobs <- job:
+					log.Printf(
+						"{%d} Queued command %d/%d: %q\n",
+						ord, n+1, len(metrics), m.command)
+				default:
+					log.Printf(
+						"{%d} Skipping command %d/%d, queue is full: %q\n",
+						ord, n+1, len(metrics), m.command)
+					atomic.StoreInt32(job.busy, 0)
+				}
 			}
 		}
 	}
@@ -77,6 +614,10 @@ func validate_metrics(metrics []*metric) error {
 			log.Println("... and the name is not valid.")
 			in_err = true
 		}
+		if strings.HasPrefix(m.name, SELF_PREFIX) {
+			log.Println("... and the name is reserved for self-monitoring.")
+			in_err = true
+		}
 	}
 	if in_err {
 		return errors.New("one or more metrics did not validate")
@@ -84,6 +625,61 @@ func validate_metrics(metrics []*metric) error {
 	return nil
 }
 
+func validate_metrics_unique(metrics []*metric) error {
+	seen := map[string]bool{}
+	for _, m := range metrics {
+		if seen[m.name] {
+			return fmt.Errorf("metric name defined more than once: %s", m.name)
+		}
+		seen[m.name] = true
+	}
+	return nil
+}
+
+// metric_is_stored tells if the metric has a table of its own. Multi-value
+// metrics only run the command and their children store the values.
+func metric_is_stored(m *metric) bool {
+	return len(m.children) == 0 && !metric_is_derived(m)
+}
+
+// metric_is_derived tells if the metric is computed from other metrics.
+func metric_is_derived(m *metric) bool {
+	return m.derived != nil
+}
+
+// metric_is_graphed tells if the metric is shown in the graphs.
+func metric_is_graphed(m *metric) bool {
+	return metric_is_stored(m) || metric_is_derived(m)
+}
+
+// metric_is_measured tells if the metric has a command which should be
+// scheduled.
+func metric_is_measured(m *metric) bool {
+	return m.parent == nil && !metric_is_push_only(m)
+}
+
+// metric_is_push_only tells if the metric has no command. Its values are
+// only pushed.
+func metric_is_push_only(m *metric) bool {
+	return m.command == ""
+}
+
+// metric_runs_command tells if the metric's values are obtained by running a
+// command.
+func metric_runs_command(m *metric) bool {
+	return !metric_is_builtin(m) && !metric_is_scrape(m) && !metric_is_push_only(m)
+}
+
+func metrics_filter(metrics []*metric, pred func(*metric) bool) []*metric {
+	ret := []*metric{}
+	for _, m := range metrics {
+		if pred(m) {
+			ret = append(ret, m)
+		}
+	}
+	return ret
+}
+
 func metric_find(metrics []*metric, name string) *metric {
 	for _, cur := range metrics {
 		if cur.name == name {
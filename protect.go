@@ -2,10 +2,14 @@
 
 package main
 
-func protect_serve(path_db string) error {
+func protect_serve(path_db, path_config, path_template string) error {
 	return nil
 }
 
-func protect_measure() error {
+func protect_measure(push, scrape bool) error {
 	return nil
 }
+
+func protect_measure_reloadable(scrape_pledged, scrape bool) bool {
+	return true
+}
@@ -14,19 +14,31 @@ const (
 	execpromises_serve = ""
 
 	promises_measure = "stdio proc exec flock rpath wpath cpath tmppath"
+	// Accepting pushed values requires listening on a socket.
+	promises_push = "inet unix"
+	// Scraping over HTTP requires connecting to other hosts.
+	promises_scrape = "inet dns"
 
 	// `serve` may not need `c` for the database directory with SQLite, but
 	// we'll give it just in case. It may be that WAL maintenance requires
 	// this even though `serve` is using read-only access.
 	unveilflags_db  = "rwc"
 	unveilflags_tmp = "rwc"
+	// The configuration and the template are read again on SIGHUP.
+	unveilflags_config = "r"
 )
 
-func protect_serve(path_db string) error {
+func protect_serve(path_db, path_config, path_template string) error {
 	log.Printf("unveil database directory: path=%q, flags=%q\n", path_db, unveilflags_db)
 	if err := unix.Unveil(path_db, unveilflags_db); err != nil {
 		return err
 	}
+	for _, p := range []string{path_config, path_template} {
+		log.Printf("unveil configuration: path=%q, flags=%q\n", p, unveilflags_config)
+		if err := unix.Unveil(p, unveilflags_config); err != nil {
+			return err
+		}
+	}
 	log.Printf("unveil temp directory: path=%q, flags=%q\n", os.TempDir(), unveilflags_tmp)
 	if err := unix.Unveil(os.TempDir(), unveilflags_tmp); err != nil {
 		return err
@@ -41,12 +53,26 @@ func protect_serve(path_db string) error {
 	return nil
 }
 
-func protect_measure() error {
+func protect_measure(push, scrape bool) error {
 	// measure is hard to unveil, because it has to be compatible with a
 	// very rich selection of shell commands.
-	log.Printf("pledge: promises=%q\n", promises_measure)
-	if err := unix.PledgePromises(promises_measure); err != nil {
+	promises := promises_measure
+	if push {
+		promises += " " + promises_push
+	}
+	if scrape {
+		promises += " " + promises_scrape
+	}
+	log.Printf("pledge: promises=%q\n", promises)
+	if err := unix.PledgePromises(promises); err != nil {
 		return err
 	}
 	return nil
 }
+
+// protect_measure_reloadable tells if the reloaded metrics fit the promises
+// given at start. Pledging cannot be relaxed later, and a scrape over HTTP
+// without them would get measure killed.
+func protect_measure_reloadable(scrape_pledged, scrape bool) bool {
+	return scrape_pledged || !scrape
+}
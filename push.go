@@ -0,0 +1,332 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// push_value is a single value in the batch form of pushing. The timestamp is
+// optional and may be either Unix seconds or an RFC3339 string.
+type push_value struct {
+	Metric string          `json:"metric"`
+	Value  *float64        `json:"value"`
+	Ts     json.RawMessage `json:"ts,omitempty"`
+}
+
+// push_state contains the metrics which values may be pushed for. They are
+// replaced when the configuration is reloaded.
+type push_state struct {
+	sync.RWMutex
+	metrics []*metric
+}
+
+func (s *push_state) get() []*metric {
+	s.RLock()
+	defer s.RUnlock()
+	return s.metrics
+}
+
+func (s *push_state) set(metrics []*metric) {
+	s.Lock()
+	defer s.Unlock()
+	s.metrics = metrics
+}
+
+// push_parse_ts parses a timestamp given either as Unix seconds or in RFC3339
+// format. An empty timestamp means now.
+func push_parse_ts(raw string) (time.Time, error) {
+	if raw == "" {
+		return time.Now(), nil
+	}
+	if secs, err := strconv.ParseFloat(raw, 64); err == nil {
+		return time_from_unix(secs), nil
+	}
+	ts, err := time.Parse(time.RFC3339Nano, raw)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("bad timestamp: %q", raw)
+	}
+	return ts, nil
+}
+
+// time_from_unix converts fractional Unix seconds to time. Rounding to
+// microseconds avoids float artifacts.
+func time_from_unix(secs float64) time.Time {
+	return time.Unix(0, int64(math.Round(secs*1e6))*int64(time.Microsecond))
+}
+
+func push_parse_json_ts(raw json.RawMessage) (time.Time, error) {
+	if len(raw) > 0 && raw[0] == '"' {
+		var s string
+		if err := json.Unmarshal(raw, &s); err != nil {
+			return time.Time{}, err
+		}
+		return push_parse_ts(s)
+	}
+	return push_parse_ts(string(raw))
+}
+
+func push_parse_batch(r io.Reader, metrics []*metric) ([]*measurement, error) {
+	var values []push_value
+	if err := json.NewDecoder(r).Decode(&values); err != nil {
+		return nil, fmt.Errorf("bad JSON: %w", err)
+	}
+	ret := []*measurement{}
+	for n, v := range values {
+		m := metric_find(metrics, v.Metric)
+		if m == nil {
+			return nil, fmt.Errorf("value %d: unknown metric: %q", n, v.Metric)
+		}
+		if v.Value == nil {
+			return nil, fmt.Errorf("value %d: missing value", n)
+		}
+		ts, err := push_parse_json_ts(v.Ts)
+		if err != nil {
+			return nil, fmt.Errorf("value %d: %w", n, err)
+		}
+		ret = append(ret, &measurement{metric: m, value: *v.Value, ts: ts})
+	}
+	return ret, nil
+}
+
+func push_parse_single(r io.Reader, m *metric, raw_ts string) (*measurement, error) {
+	body, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	value, err := strconv.ParseFloat(strings.TrimSpace(string(body)), 64)
+	if err != nil {
+		return nil, fmt.Errorf("not floaty: %q", truncate(string(body), 64))
+	}
+	ts, err := push_parse_ts(raw_ts)
+	if err != nil {
+		return nil, err
+	}
+	return &measurement{metric: m, value: value, ts: ts}, nil
+}
+
+// push_handler_gen accepts values either one at a time with
+//
+//	POST /push/<metric>?ts=<timestamp>
+//
+// where the body is the value, or as a batch with
+//
+//	POST /push
+//
+// where the body is a JSON array of push_values. A batch is accepted only if
+// all of its values are valid.
+func push_handler_gen(ctx context.Context, state *push_state, tasks chan<- db_task,
+	label string) http.HandlerFunc {
+
+	return func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			fmt.Fprintln(w, "only POST is supported")
+			return
+		}
+		metrics := state.get()
+		body := http.MaxBytesReader(w, req.Body, MAX_PUSH_BODY)
+
+		var measurements []*measurement
+		name := strings.TrimPrefix(strings.TrimPrefix(req.URL.Path, "/push"), "/")
+		if name == "" {
+			var err error
+			measurements, err = push_parse_batch(body, metrics)
+			if err != nil {
+				log.Println(label, ": bad batch: ", err)
+				w.WriteHeader(http.StatusBadRequest)
+				fmt.Fprintln(w, err)
+				return
+			}
+		} else {
+			m := metric_find(metrics, name)
+			if m == nil {
+				log.Println(label, ": unknown metric: ", name)
+				w.WriteHeader(http.StatusNotFound)
+				fmt.Fprintln(w, "unknown metric")
+				return
+			}
+			measurement, err := push_parse_single(body, m, req.URL.Query().Get("ts"))
+			if err != nil {
+				log.Println(label, ": bad value for ", name, ": ", err)
+				w.WriteHeader(http.StatusBadRequest)
+				fmt.Fprintln(w, err)
+				return
+			}
+			measurements = append(measurements, measurement)
+		}
+
+		for _, m := range measurements {
+			select {
+			case tasks <- db_task{kind: DB_TASK_INSERT, insert_measurement: m}:
+			case <-req.Context().Done():
+				log.Println(label, ": request cancelled")
+				return
+			case <-ctx.Done():
+				log.Println(label, ": stopping, dropping values")
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+		}
+		log.Println(label, ": accepted", len(measurements), "value(s)")
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// push_listen listens on either a TCP address or a Unix socket if the address
+// has the Unix prefix. A stale socket is removed first.
+func push_listen(addr string) (net.Listener, error) {
+	if !strings.HasPrefix(addr, PUSH_UNIX_PREFIX) {
+		return net.Listen("tcp", addr)
+	}
+	path := strings.TrimPrefix(addr, PUSH_UNIX_PREFIX)
+	if fi, err := os.Stat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		log.Println("Removing stale push socket at ", path)
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+	return net.Listen("unix", path)
+}
+
+// push_serve accepts pushed values until ctx is done. The handlers have
+// returned when push_serve returns, so nothing is sent to tasks after that.
+func push_serve(ctx context.Context, l net.Listener, state *push_state,
+	tasks chan<- db_task, shutdown_timeout time.Duration) {
+
+	// After shutting down, no new requests are started, but ones still
+	// running may have to be waited for.
+	var wg sync.WaitGroup
+	push := push_handler_gen(ctx, state, tasks, "push")
+	handler := func(w http.ResponseWriter, req *http.Request) {
+		wg.Add(1)
+		defer wg.Done()
+		push(w, req)
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/push", handler)
+	mux.HandleFunc("/push/", handler)
+	srv := &http.Server{Handler: mux}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		<-ctx.Done()
+		sctx, cf := context.WithTimeout(context.Background(), shutdown_timeout)
+		defer cf()
+		if err := srv.Shutdown(sctx); err != nil {
+			log.Println("push: shutdown: ", err)
+		}
+		wg.Wait()
+	}()
+	log.Println("Accepting pushed values at ", l.Addr())
+	if err := srv.Serve(l); !errors.Is(err, http.ErrServerClosed) {
+		log.Println("push: ", err)
+	}
+	<-done
+}
+
+// push_send pushes a value to a running `measure`.
+func push_send(addr string, m *metric, value float64, ts time.Time) error {
+	client := &http.Client{Timeout: PUSH_CLIENT_TIMEOUT}
+	host := addr
+	if strings.HasPrefix(addr, PUSH_UNIX_PREFIX) {
+		path := strings.TrimPrefix(addr, PUSH_UNIX_PREFIX)
+		client.Transport = &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", path)
+			},
+		}
+		// The host is ignored, but it has to be there.
+		host = "lilmon"
+	}
+	u := fmt.Sprintf(
+		"http://%s/push/%s?ts=%s", host, m.name, url.QueryEscape(ts.Format(time.RFC3339Nano)))
+	resp, err := client.Post(u, "text/plain", strings.NewReader(strconv.FormatFloat(value, 'g', -1, 64)))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return &push_rejected{status: resp.Status, msg: strings.TrimSpace(string(body))}
+	}
+	return nil
+}
+
+type push_rejected struct {
+	status, msg string
+}
+
+func (e *push_rejected) Error() string {
+	return fmt.Sprintf("measure rejected the value: %s: %s", e.status, e.msg)
+}
+
+// push_write_db writes a value directly to the database.
+func push_write_db(path_db string, m *metric, value float64, ts time.Time) error {
+	db := db_init(db_path_measure(path_db))
+	defer db.Close()
+	if err := db_migrate(db, []*metric{m}); err != nil {
+		return err
+	}
+	_, err := db_insert(context.Background(), db, []*measurement{{metric: m, value: value, ts: ts}})
+	return err
+}
+
+// push_metric pushes a value to a running `measure` if it is listening for
+// pushed values. Otherwise the value is written directly to the database.
+func push_metric(mconfig *config_measure, m *metric, value float64, ts time.Time) error {
+	if mconfig.push_addr != "" {
+		err := push_send(mconfig.push_addr, m, value, ts)
+		var rejected *push_rejected
+		if err == nil || errors.As(err, &rejected) {
+			return err
+		}
+		log.Println("cannot reach measure, writing to database directly: ", err)
+	}
+	return push_write_db(mconfig.path_db, m, value, ts)
+}
+
+func push(path_config, name, raw_value, raw_ts string) {
+	config, err := config_load_file(path_config)
+	if err != nil {
+		log.Fatal(err)
+	}
+	mconfig, err := config.parse_measure()
+	if err != nil {
+		log.Fatal(err)
+	}
+	metrics, err := config.parse_metrics()
+	if err != nil {
+		log.Fatal("config file reading failed, cannot proceed with push: ", err)
+	}
+	m := metric_find(metrics_filter(metrics, metric_is_stored), name)
+	if m == nil {
+		log.Fatalf("unknown metric: %q\n", name)
+	}
+	value, err := strconv.ParseFloat(strings.TrimSpace(raw_value), 64)
+	if err != nil {
+		log.Fatalf("not floaty: %q\n", raw_value)
+	}
+	ts, err := push_parse_ts(raw_ts)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := push_metric(mconfig, m, value, ts); err != nil {
+		log.Fatal("push failed: ", err)
+	}
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Scrapes read a Prometheus or OpenMetrics text exposition either via HTTP or
+// from a file, and sum the values of the matching series. They are given as
+// commands like
+//
+//	scrape:<url or path> <selector>
+//
+// where the selector is like `name{label="value",other=~"regex"}`.
+type scrape_matcher struct {
+	label, op, value string
+	re               *regexp.Regexp
+}
+
+type scrape_selector struct {
+	name     string
+	matchers []scrape_matcher
+}
+
+func metric_is_scrape(m *metric) bool {
+	return strings.HasPrefix(m.command, SCRAPE_PREFIX)
+}
+
+// metric_is_scrape_http tells if the metric scrapes over the network instead of
+// a file.
+func metric_is_scrape_http(m *metric) bool {
+	if !metric_is_scrape(m) {
+		return false
+	}
+	source := strings.TrimPrefix(m.command, SCRAPE_PREFIX)
+	return strings.HasPrefix(source, "http://") || strings.HasPrefix(source, "https://")
+}
+
+func scrape_name_len(s string) int {
+	for i, c := range s {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c == '_', c == ':':
+		case c >= '0' && c <= '9' && i > 0:
+		default:
+			return i
+		}
+	}
+	return len(s)
+}
+
+// scrape_parse_labels parses the labels after the opening brace until the
+// closing brace. The rest of the string is returned.
+func scrape_parse_labels(s string) ([]scrape_matcher, string, error) {
+	ret := []scrape_matcher{}
+	for {
+		s = strings.TrimLeft(s, " \t")
+		if strings.HasPrefix(s, "}") {
+			return ret, s[1:], nil
+		}
+		n := scrape_name_len(s)
+		if n == 0 {
+			return nil, "", fmt.Errorf("bad label name at %q", truncate(s, 16))
+		}
+		cur := scrape_matcher{label: s[:n]}
+		s = strings.TrimLeft(s[n:], " \t")
+		for _, op := range []string{"=~", "!~", "!=", "="} {
+			if strings.HasPrefix(s, op) {
+				cur.op = op
+				break
+			}
+		}
+		if cur.op == "" {
+			return nil, "", fmt.Errorf("missing operator for label %s", cur.label)
+		}
+		s = strings.TrimLeft(s[len(cur.op):], " \t")
+		if !strings.HasPrefix(s, `"`) {
+			return nil, "", fmt.Errorf("unquoted value for label %s", cur.label)
+		}
+		value := strings.Builder{}
+		i := 1
+		for ; i < len(s) && s[i] != '"'; i++ {
+			if s[i] == '\\' && i+1 < len(s) {
+				i++
+				if s[i] == 'n' {
+					value.WriteByte('\n')
+					continue
+				}
+			}
+			value.WriteByte(s[i])
+		}
+		if i == len(s) {
+			return nil, "", fmt.Errorf("unterminated value for label %s", cur.label)
+		}
+		cur.value = value.String()
+		if cur.op == "=~" || cur.op == "!~" {
+			re, err := regexp.Compile("^(?:" + cur.value + ")$")
+			if err != nil {
+				return nil, "", fmt.Errorf("label %s: %w", cur.label, err)
+			}
+			cur.re = re
+		}
+		ret = append(ret, cur)
+		s = strings.TrimLeft(s[i+1:], " \t")
+		s = strings.TrimPrefix(s, ",")
+	}
+}
+
+func scrape_parse(command string) (string, *scrape_selector, error) {
+	// The selector is kept as it was written, as label values may contain
+	// whitespace.
+	command = strings.TrimSpace(strings.TrimPrefix(command, SCRAPE_PREFIX))
+	i := strings.IndexAny(command, " \t")
+	if i == -1 {
+		return "", nil, errors.New("scrape requires a source and a selector")
+	}
+	source := command[:i]
+	raw := strings.TrimLeft(command[i:], " \t")
+	n := scrape_name_len(raw)
+	if n == 0 {
+		return "", nil, fmt.Errorf("bad metric name in selector: %q", raw)
+	}
+	sel := &scrape_selector{name: raw[:n]}
+	rest := raw[n:]
+	if strings.HasPrefix(rest, "{") {
+		var err error
+		sel.matchers, rest, err = scrape_parse_labels(rest[1:])
+		if err != nil {
+			return "", nil, err
+		}
+	}
+	if strings.TrimSpace(rest) != "" {
+		return "", nil, fmt.Errorf("trailing garbage in selector: %q", rest)
+	}
+	return source, sel, nil
+}
+
+func (m *scrape_matcher) matches(labels map[string]string) bool {
+	v := labels[m.label]
+	switch m.op {
+	case "=":
+		return v == m.value
+	case "!=":
+		return v != m.value
+	case "=~":
+		return m.re.MatchString(v)
+	case "!~":
+		return !m.re.MatchString(v)
+	}
+	panic(fmt.Sprintf("This is a bug: unknown operator %q", m.op))
+}
+
+// scrape_sum sums the values of the series matching the selector. Comments,
+// metadata, and lines which cannot be parsed are skipped.
+func scrape_sum(exposition string, sel *scrape_selector) (float64, int) {
+	sum := float64(0)
+	n := 0
+	for _, line := range strings.Split(exposition, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		nl := scrape_name_len(line)
+		if line[:nl] != sel.name {
+			continue
+		}
+		rest := line[nl:]
+		labels := map[string]string{}
+		if strings.HasPrefix(rest, "{") {
+			matchers, r, err := scrape_parse_labels(rest[1:])
+			if err != nil {
+				continue
+			}
+			for _, m := range matchers {
+				labels[m.label] = m.value
+			}
+			rest = r
+		}
+		// The value may be followed by a timestamp, which we ignore.
+		fields := strings.Fields(rest)
+		if len(fields) == 0 {
+			continue
+		}
+		value, err := strconv.ParseFloat(fields[0], 64)
+		if err != nil {
+			continue
+		}
+		matched := true
+		for i := range sel.matchers {
+			if !sel.matchers[i].matches(labels) {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			sum += value
+			n++
+		}
+	}
+	return sum, n
+}
+
+func scrape_fetch(ctx context.Context, source string) (string, error) {
+	var r io.Reader
+	if strings.HasPrefix(source, "http://") || strings.HasPrefix(source, "https://") {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, source, nil)
+		if err != nil {
+			return "", err
+		}
+		req.Header.Set("Accept", "text/plain")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return "", err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return "", fmt.Errorf("unexpected status: %s", resp.Status)
+		}
+		r = resp.Body
+	} else {
+		f, err := os.Open(strings.TrimPrefix(source, "file://"))
+		if err != nil {
+			return "", err
+		}
+		defer f.Close()
+		r = f
+	}
+	b, err := io.ReadAll(io.LimitReader(r, MAX_SCRAPE_BODY))
+	return string(b), err
+}
+
+func exec_scrape(ctx context.Context, m *metric) (float64, error) {
+	source, sel, err := scrape_parse(m.command)
+	if err != nil {
+		return 0, err
+	}
+	exposition, err := scrape_fetch(ctx, source)
+	if err != nil {
+		return 0, err
+	}
+	sum, n := scrape_sum(exposition, sel)
+	if n == 0 {
+		return 0, fmt.Errorf("no series matched %s", sel.name)
+	}
+	return sum, nil
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// Self-monitoring metrics describe the health of lilmon itself. They are
+// recorded by `measure` and `serve` and graphed like any other metric, but
+// they need no configuration. Their names begin with SELF_PREFIX, which is
+// reserved from configured metrics.
+const (
+	// SELF_COUNT is the amount of events during the period.
+	SELF_COUNT = iota
+	// SELF_MEAN is the mean of the observations during the period.
+	SELF_MEAN
+	// SELF_GAUGE is sampled when recording.
+	SELF_GAUGE
+)
+
+type self_metric struct {
+	metric *metric
+	kind   int
+
+	lock sync.Mutex
+	sum  float64
+	n    int
+}
+
+func self_metric_new(name, description string, kind int, kibi bool) *self_metric {
+	y_min := float64(0)
+	return &self_metric{
+		metric: &metric{
+			name:        SELF_PREFIX + name,
+			description: description,
+			options:     graph_options{y_min: &y_min, kibi: kibi},
+		},
+		kind: kind,
+	}
+}
+
+var (
+	self_commands_run    = self_metric_new("commands_run", "lilmon: commands run", SELF_COUNT, false)
+	self_commands_failed = self_metric_new("commands_failed", "lilmon: commands failed", SELF_COUNT, false)
+	self_write_queue     = self_metric_new("write_queue", "lilmon: write queue depth", SELF_GAUGE, false)
+	self_commit_time     = self_metric_new("commit_time", "lilmon: database commit time (s)", SELF_MEAN, false)
+	self_prune_time      = self_metric_new("prune_time", "lilmon: table pruning time (s)", SELF_MEAN, false)
+	self_db_size         = self_metric_new("db_size", "lilmon: database size", SELF_GAUGE, true)
+	self_wal_size        = self_metric_new("wal_size", "lilmon: WAL size", SELF_GAUGE, true)
+
+	self_requests    = self_metric_new("requests", "lilmon: requests to serve", SELF_COUNT, false)
+	self_render_time = self_metric_new("render_time", "lilmon: graph render time (s)", SELF_MEAN, false)
+
+	self_metrics_measure = []*self_metric{
+		self_commands_run, self_commands_failed, self_write_queue,
+		self_commit_time, self_prune_time, self_db_size, self_wal_size,
+	}
+	self_metrics_serve = []*self_metric{self_requests, self_render_time}
+)
+
+// self_metrics returns the metrics of both `measure` and `serve`.
+func self_metrics() []*metric {
+	ret := []*metric{}
+	for _, s := range append(self_metrics_measure, self_metrics_serve...) {
+		ret = append(ret, s.metric)
+	}
+	return ret
+}
+
+func (s *self_metric) observe(v float64) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.sum += v
+	s.n++
+}
+
+// take returns the sum and the amount of observations since the previous call.
+func (s *self_metric) take() (float64, int) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	sum, n := s.sum, s.n
+	s.sum, s.n = 0, 0
+	return sum, n
+}
+
+// self_file_size returns zero for missing files, as the WAL may not exist.
+func self_file_size(path string) (float64, error) {
+	fi, err := os.Stat(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return float64(fi.Size()), nil
+}
+
+// self_recorder records the metrics each period until ctx is done. Gauges are
+// sampled with the given functions.
+func self_recorder(ctx context.Context, tasks chan<- db_task, metrics []*self_metric,
+	gauges map[*self_metric]func() (float64, error), period time.Duration) {
+
+	log.Println("Recording self-monitoring metrics with period of ", period)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(period):
+		}
+		ts := time.Now()
+		for _, s := range metrics {
+			sum, n := s.take()
+			switch s.kind {
+			case SELF_COUNT:
+				measurement_send(s.metric, sum, ts, tasks)
+			case SELF_MEAN:
+				if n > 0 {
+					measurement_send(s.metric, sum/float64(n), ts, tasks)
+				}
+			case SELF_GAUGE:
+				sample, ok := gauges[s]
+				if !ok {
+					continue
+				}
+				v, err := sample()
+				if err != nil {
+					log.Printf("self-monitoring: cannot sample %s: %v\n", s.metric.name, err)
+					continue
+				}
+				measurement_send(s.metric, v, ts, tasks)
+			}
+		}
+	}
+}
+
+// self_counted counts the requests handled by h.
+func self_counted(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		self_requests.observe(1)
+		h(w, req)
+	}
+}
@@ -2,14 +2,19 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"database/sql"
 	"fmt"
 	"html/template"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
 	"path"
 	"strconv"
+	"strings"
+	"sync"
+	"syscall"
 	"time"
 )
 
@@ -30,14 +35,33 @@ func determine_timestamp_format(time_start, time_end time.Time) string {
 	return tf
 }
 
-func serve_index_gen(db *sql.DB, metrics []*metric, label string,
-	sconfig *config_serve, template *template.Template) http.HandlerFunc {
+func failure_format(f *measurement_failure) string {
+	ret := f.reason
+	if f.exit_code > 0 {
+		ret = fmt.Sprintf("%s (exit code %d)", ret, f.exit_code)
+	}
+	if stderr := strings.TrimSpace(f.stderr); stderr != "" {
+		ret += ": " + stderr
+	}
+	return ret
+}
 
+func serve_index_gen(db *sql.DB, state *serve_state, label string) http.HandlerFunc {
 	return func(w http.ResponseWriter, req *http.Request) {
+		metrics, sconfig, template := state.get()
 		v := req.URL.Query()
 		raw_time_starts, ok_start := v["time_start"]
 		raw_time_ends, ok_end := v["time_end"]
 		_, no_ds := v["no_ds"]
+		agg := v.Get("agg")
+		if agg != "" {
+			if _, err := agg_parse(agg); err != nil {
+				log.Println(label, ": bad aggregation:", err)
+				w.WriteHeader(http.StatusBadRequest)
+				fmt.Fprintln(w, "bad aggregation")
+				return
+			}
+		}
 
 		var time_start, time_end time.Time
 		var err_start, err_end error
@@ -71,12 +95,36 @@ func serve_index_gen(db *sql.DB, metrics []*metric, label string,
 			return
 		}
 
+		failures, err := db_failures_get(db, time_start, time_end)
+		if err != nil {
+			log.Println(label, ": cannot get failures: ", err)
+		}
+
 		type MetricData struct {
 			Name, Description string
+			Aggregation       string
+			Failures          int
+			LastFailure       string
+			LastFailureTime   time.Time
 		}
 		md := []MetricData{}
 		for _, m := range metrics {
-			md = append(md, MetricData{Name: m.name, Description: m.description})
+			cur := MetricData{Name: m.name, Description: m.description, Aggregation: agg}
+			if agg == "" {
+				cur.Aggregation = metric_agg(m)
+			}
+			// Series of multi-value metrics fail together with their
+			// parent's command.
+			measured := m
+			if m.parent != nil {
+				measured = m.parent
+			}
+			if fs, ok := failures[measured.name]; ok {
+				cur.Failures = fs.count
+				cur.LastFailure = failure_format(&fs.latest)
+				cur.LastFailureTime = fs.ts
+			}
+			md = append(md, cur)
 		}
 
 		template_data := struct {
@@ -88,6 +136,7 @@ func serve_index_gen(db *sql.DB, metrics []*metric, label string,
 			TimeFormat           string
 			RenderTime           time.Time
 			NoDownsampling       bool
+			Aggregation          string
 		}{
 			Title:          "lilmon",
 			RefreshPeriod:  sconfig.autorefresh_period,
@@ -99,13 +148,15 @@ func serve_index_gen(db *sql.DB, metrics []*metric, label string,
 			TimeFormat:     determine_timestamp_format(time_start, time_end),
 			RenderTime:     time.Now(),
 			NoDownsampling: no_ds,
+			Aggregation:    agg,
 		}
 		template.Execute(w, template_data)
 	}
 }
 
-func serve_graph_gen(db *sql.DB, metrics []*metric, label string, sconfig *config_serve) http.HandlerFunc {
+func serve_graph_gen(db *sql.DB, state *serve_state, label string) http.HandlerFunc {
 	return func(w http.ResponseWriter, req *http.Request) {
+		metrics, sconfig, _ := state.get()
 		v := req.URL.Query()
 		epoch_starts_raw, ok_start := v["epoch_start"]
 		epoch_ends_raw, ok_end := v["epoch_end"]
@@ -146,6 +197,19 @@ func serve_graph_gen(db *sql.DB, metrics []*metric, label string, sconfig *confi
 			return
 		}
 
+		// The aggregation is overridden only for this graph.
+		if agg := v.Get("agg"); agg != "" {
+			if _, err := agg_parse(agg); err != nil {
+				log.Println(label, ": bad aggregation:", err)
+				w.WriteHeader(http.StatusBadRequest)
+				fmt.Fprintln(w, "bad aggregation")
+				return
+			}
+			overridden := *metric
+			overridden.options.agg = agg
+			metric = &overridden
+		}
+
 		if epoch_start >= epoch_end {
 			log.Println(label, ": epoch_start >= epoch_end")
 			w.WriteHeader(http.StatusBadRequest)
@@ -160,7 +224,9 @@ func serve_graph_gen(db *sql.DB, metrics []*metric, label string, sconfig *confi
 			metric_names[0], time_start, time_end)
 
 		b := bytes.Buffer{}
+		t0 := time.Now()
 		err := graph_generate(db, metric, no_ds, time_start, time_end, &b, sconfig)
+		self_render_time.observe(time.Since(t0).Seconds())
 		if err != nil {
 			log.Println(label, ": graph generation failed: ", err)
 			w.WriteHeader(http.StatusInternalServerError)
@@ -175,23 +241,142 @@ func serve_graph_gen(db *sql.DB, metrics []*metric, label string, sconfig *confi
 	}
 }
 
-func serve(path_config string) {
+// serve_metrics_gen exposes the latest value of each metric in the Prometheus
+// text format.
+func serve_metrics_gen(db *sql.DB, state *serve_state, label string) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		metrics, _, _ := state.get()
+		b := bytes.Buffer{}
+		for _, m := range metrics {
+			// Derived metrics have no values of their own.
+			if metric_is_derived(m) {
+				continue
+			}
+			value, ts, err := db_latest_get(db, m)
+			if err != nil {
+				log.Println(label, ": cannot get latest value for ", m.name, ": ", err)
+				continue
+			}
+			openmetrics_help(&b, m)
+			if !ts.IsZero() {
+				fmt.Fprintf(&b, "%s %s %d\n",
+					openmetrics_name(m), strconv.FormatFloat(value, 'g', -1, 64), ts.UnixMilli())
+			}
+		}
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		w.Header().Set("Content-Length", strconv.Itoa(b.Len()))
+		w.WriteHeader(http.StatusOK)
+		w.Write(b.Bytes())
+	}
+}
+
+// serve_state contains everything which is replaced when the configuration is
+// reloaded.
+type serve_state struct {
+	sync.RWMutex
+	metrics  []*metric
+	sconfig  *config_serve
+	template *template.Template
+}
+
+func (s *serve_state) get() ([]*metric, *config_serve, *template.Template) {
+	s.RLock()
+	defer s.RUnlock()
+	return s.metrics, s.sconfig, s.template
+}
+
+func (s *serve_state) set(metrics []*metric, sconfig *config_serve, template *template.Template) {
+	s.Lock()
+	defer s.Unlock()
+	s.metrics, s.sconfig, s.template = metrics, sconfig, template
+}
+
+func serve_load(path_config string) ([]*metric, *config_serve, *template.Template, error) {
 	config, err := config_load_file(path_config)
 	if err != nil {
-		log.Fatal(err)
+		return nil, nil, nil, err
 	}
 	metrics, err := config.parse_metrics()
 	if err != nil {
-		log.Fatal("config file reading failed, cannot proceed with serve: ", err)
+		return nil, nil, nil, fmt.Errorf("config file reading failed: %w", err)
 	}
+	// Self-monitoring metrics are shown after the configured ones.
+	metrics = append(metrics_filter(metrics, metric_is_graphed), self_metrics()...)
 	sconfig, err := config.parse_serve()
 	if err != nil {
-		log.Fatal("parsing serve config failed: ", err)
+		return nil, nil, nil, fmt.Errorf("parsing serve config failed: %w", err)
 	}
 	if _, err := os.Stat(sconfig.path_template); err != nil {
-		log.Fatal("cannot open template: ", err)
+		return nil, nil, nil, fmt.Errorf("cannot open template: %w", err)
+	}
+	t, err := template.ParseFiles(sconfig.path_template)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("cannot parse template: %w", err)
+	}
+	return metrics, sconfig, t, nil
+}
+
+func serve_reload(path_config string, state *serve_state) {
+	metrics, sconfig, template, err := serve_load(path_config)
+	if err != nil {
+		log.Println("reloading failed, keeping old configuration: ", err)
+		return
+	}
+	_, sconfig_old, _ := state.get()
+	// The database and the listener are not reopened.
+	if sconfig.path_db != sconfig_old.path_db {
+		log.Println("warning: path_db changed, restart serve to use it")
+	}
+	if sconfig.listen_addr != sconfig_old.listen_addr {
+		log.Println("warning: listen_addr changed, restart serve to use it")
+	}
+	sconfig.path_db = sconfig_old.path_db
+	sconfig.listen_addr = sconfig_old.listen_addr
+	state.set(metrics, sconfig, template)
+	log.Println("reloaded configuration with", len(metrics), "metrics")
+}
+
+// serve_self_init opens the connection for writing the self-monitoring values
+// of serve. The graphs are drawn from a read-only connection, and serve works
+// without write access to the database, too. Then nil is returned and the
+// values are not recorded.
+func serve_self_init(db_path string) *sql.DB {
+	db := db_init(db_path)
+	err := db_migrate(db, self_metrics())
+	if err == nil {
+		err = serve_self_check(db)
+	}
+	if err != nil {
+		log.Println("warning: cannot write to database, not recording self-monitoring values: ", err)
+		db.Close()
+		return nil
+	}
+	return db
+}
+
+// serve_self_check tries an insert which is rolled back. Migrating is not
+// enough, because creating tables which exist already succeeds also without
+// write access.
+func serve_self_check(db *sql.DB) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
 	}
-	template := template.Must(template.ParseFiles(sconfig.path_template))
+	defer tx.Rollback()
+	_, err = tx.Exec(
+		fmt.Sprintf(`INSERT INTO %s (value, timestamp) VALUES (?, ?)`,
+			db_table_name_get(self_requests.metric)),
+		0, db_timestamp(time.Now()))
+	return err
+}
+
+func serve(path_config string) {
+	metrics, sconfig, template, err := serve_load(path_config)
+	if err != nil {
+		log.Fatal("cannot proceed with serve: ", err)
+	}
+	state := &serve_state{}
+	state.set(metrics, sconfig, template)
 
 	if _, err := os.Stat(sconfig.path_db); err != nil {
 		log.Println("Cannot open database: ", err)
@@ -209,11 +394,29 @@ func serve(path_config string) {
 		}
 	}()
 
-	http.HandleFunc("/", serve_index_gen(db, metrics, "index", sconfig, template))
-	http.HandleFunc("/graph", serve_graph_gen(db, metrics, "graph", sconfig))
+	if db_self := serve_self_init(db_path_measure(sconfig.path_db)); db_self != nil {
+		defer db_self.Close()
+		ct := make(chan db_task, DEFAULT_WRITE_QUEUE_SIZE)
+		go db_writer(context.Background(), db_self, ct, DEFAULT_WRITE_BATCH_SIZE, DEFAULT_WRITE_BATCH_DELAY)
+		go self_recorder(context.Background(), ct, self_metrics_serve, nil, sconfig.measure_period)
+	}
+
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGHUP)
+	go func() {
+		for range ch {
+			log.Println("got SIGHUP -- reloading configuration from ", path_config)
+			serve_reload(path_config, state)
+		}
+	}()
+
+	http.HandleFunc("/", self_counted(serve_index_gen(db, state, "index")))
+	http.HandleFunc("/graph", self_counted(serve_graph_gen(db, state, "graph")))
+	http.HandleFunc("/metrics", self_counted(serve_metrics_gen(db, state, "metrics")))
 	log.Println("Listening at address ", sconfig.listen_addr)
 
-	if err := protect_serve(path.Dir(sconfig.path_db)); err != nil {
+	if err := protect_serve(
+		path.Dir(sconfig.path_db), path_config, sconfig.path_template); err != nil {
 		log.Fatal("protect: ", err)
 	}
 
@@ -25,14 +25,36 @@ const (
 	DEFAULT_REFRESH_PERIOD     = 2 * time.Minute
 	DEFAULT_PRUNE_PERIOD       = 15 * time.Minute
 	DEFAULT_MEASUREMENT_PERIOD = 1 * time.Minute
+	DEFAULT_RETRY_BACKOFF      = 1 * time.Second
+	DEFAULT_MAX_CONCURRENT     = 8
+	DEFAULT_SHUTDOWN_TIMEOUT   = 10 * time.Second
+	DEFAULT_WRITE_BATCH_SIZE   = 100
+	DEFAULT_WRITE_BATCH_DELAY  = 1 * time.Second
+	DEFAULT_WRITE_QUEUE_SIZE   = 1024
 	DEFAULT_BIN_WIDTH          = 1 * time.Minute
 	DEFAULT_MAX_BINS           = DEFAULT_GRAPH_WIDTH / 1
 	DEFAULT_DOWNSAMPLING_SCALE = 4
+	DEFAULT_BIN_AGG            = "avg"
 	DEFAULT_GRAPH_FORMAT       = "svg"
 	DEFAULT_GRAPH_MIMETYPE     = "image/svg+xml"
 	DEFAULT_LINE_THICKNESS     = 2
 	DEFAULT_GLYPH_SIZE         = 2
 	CONFIG_DELIM               = "|"
+	BUILTIN_PREFIX             = "builtin:"
+	SCRAPE_PREFIX              = "scrape:"
+	UNITS_SI                   = "si"
+	UNITS_IEC                  = "iec"
+	MAX_SCRAPE_BODY            = 16 << 20
+	MAX_FAILURE_STDERR         = 1024
+	FAILURES_TABLE             = "lilmon_failures"
+	SELF_PREFIX                = "lilmon_"
+	DURATION_SUFFIX            = "_duration"
+	PUSH_UNIX_PREFIX           = "unix:"
+	MAX_PUSH_BODY              = 1 << 20
+	PUSH_CLIENT_TIMEOUT        = 10 * time.Second
+	IMPORT_BATCH_SIZE          = 1000
+	FLAG_PUSH_TS               = "ts"
+	HELP_PUSH_TS               = "Time of the value as Unix seconds or in RFC3339 format, default now"
 )
 
 var (
@@ -45,8 +67,18 @@ var (
 	TIMESTAMP_FORMAT_DAY    = "Jan _2\n15:04"
 	TIMESTAMP_FORMAT_HOUR   = "15:04"
 	TIMESTAMP_FORMAT_MINUTE = "15:04:05"
+	// Timestamps are stored in UTC with millisecond precision. Trailing
+	// zeros are dropped, which keeps them comparable as strings with the
+	// second-precision timestamps of CURRENT_TIMESTAMP.
+	TIMESTAMP_FORMAT_DB = "2006-01-02 15:04:05.999"
 )
 
 var (
 	RE_NAME = regexp.MustCompile("^[_a-zA-Z0-9]{1,512}$")
+	// Derivatives may be given per these units of time.
+	RATE_UNITS = map[string]time.Duration{
+		"s":   time.Second,
+		"min": time.Minute,
+		"h":   time.Hour,
+	}
 )
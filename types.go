@@ -25,15 +25,80 @@ type config_measure struct {
 	retention_time, prune_db_period, measure_period time.Duration
 	path_db                                         string
 	shell                                           string
+	max_concurrent_commands                         int
+	shutdown_timeout                                time.Duration
+	write_batch_size, write_queue_size              int
+	write_batch_delay                               time.Duration
+	push_addr                                       string
 }
 
 type metric struct {
 	name, description, command string
 	options                    graph_options
+	measure                    measure_options
+
+	// Multi-value metrics have children. Their command output contains
+	// several named values, and each value is stored by the child with the
+	// matching key.
+	parent   *metric
+	key      string
+	children []*metric
+
+	// If the run time is recorded, it is stored by a companion metric whose
+	// parent is this metric.
+	duration *metric
+
+	// Derived metrics are computed from other metrics when graphed.
+	derived *expr
+}
+
+type measure_options struct {
+	// If neither period nor schedule is given, the metric is measured
+	// using the global measure_period.
+	period   time.Duration
+	schedule *cron_schedule
+	// Each run is delayed randomly by at most splay.
+	splay time.Duration
+
+	// Zero timeout means half of the period.
+	timeout, retry_backoff time.Duration
+	retries                int
+
+	// If units are given, the output may contain units like 12G or 1.2ms.
+	units string
+	// If an extractor is given, the value is picked from the output.
+	extract *extractor
+
+	// With argv, the command is run directly without a shell. With
+	// clean_env, lilmon's environment is not passed to the command.
+	argv, clean_env bool
+	exec            *exec_options
+
+	// With duration, also the run time of each run is recorded.
+	duration bool
+}
+
+// exec_options are set with metric attributes.
+type exec_options struct {
+	// Empty shell means the global shell.
+	shell   string
+	env     []string
+	workdir string
+	stdin   *string
 }
 
 type graph_options struct {
 	differentiate bool
+	// Counters are differentiated so that decreasing values are handled as
+	// wraps or resets. Zero counter width means the counter never wraps.
+	counter       bool
+	counter_width int
+	// Derivatives are per rate_unit, by default per second.
+	rate_unit time.Duration
+	// Empty agg means the default bin aggregation.
+	agg string
+	// Transforms are applied in order after the derivative, if any.
+	transforms    []transform
 	kibi, kilo    bool
 	no_downsample bool
 	y_min, y_max  *float64
@@ -42,6 +107,14 @@ type graph_options struct {
 type measurement struct {
 	metric *metric
 	value  float64
+	ts     time.Time
+}
+
+type measure_job struct {
+	metric  *metric
+	ord     int
+	timeout time.Duration
+	busy    *int32
 }
 
 type datapoint struct {
@@ -51,9 +124,40 @@ type datapoint struct {
 
 type bin_op func(i int, vals []float64, times []time.Time) float64
 
+// transform is a step in the pipeline of graph_options. Scale and offset use
+// x, and clamp uses x and y as its bounds.
+type transform struct {
+	kind string
+	x, y float64
+}
+
+// bin_agg aggregates the values of a bin. There is at least one value.
+type bin_agg func(vals []float64) float64
+
+// measurement_failure describes why a metric did not produce a value.
+type measurement_failure struct {
+	metric    *metric
+	reason    string
+	exit_code int
+	stderr    string
+	ts        time.Time
+}
+
+func (f *measurement_failure) Error() string {
+	return f.reason
+}
+
+type failure_summary struct {
+	count  int
+	latest measurement_failure
+	ts     time.Time
+}
+
 const (
 	DB_TASK_PRUNE_TABLE = iota
 	DB_TASK_INSERT
+	DB_TASK_FAILURE
+	DB_TASK_PRUNE_FAILURES
 )
 
 type db_task struct {
@@ -63,4 +167,5 @@ type db_task struct {
 	prune_retention_period time.Duration
 
 	insert_measurement *measurement
+	insert_failure     *measurement_failure
 }
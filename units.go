@@ -0,0 +1,101 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Values with units are converted to plain numbers:
+//
+//   - SI prefixes like 12.5G or 12.5 GB are multiplied by powers of 1000, or
+//     1024 if the metric uses IEC units
+//   - IEC prefixes like 512Ki or 512 KiB are always multiplied by powers of 1024
+//   - plain bytes like 100B or 512 B are kept as they are
+//   - percentages like 45% lose their sign
+//   - durations like 1.2ms, 3d4h, or `uptime`'s 3 days, 4:05 are in seconds
+var (
+	units_prefixes = map[string]int{
+		"k": 1, "K": 1, "M": 2, "G": 3, "T": 4, "P": 5, "E": 6,
+	}
+	units_durations = map[string]float64{
+		"ns": 1e-9, "us": 1e-6, "µs": 1e-6, "ms": 1e-3,
+		"s": 1, "m": 60, "h": 3600, "d": 86400, "w": 7 * 86400,
+	}
+	re_units_prefixed = regexp.MustCompile(
+		`^([-+]?[0-9.]+(?:[eE][-+]?[0-9]+)?)\s*(?:([kKMGTPE])(i?)[Bb]?|[Bb])$`)
+	re_units_duration_part = regexp.MustCompile(`([0-9]+(?:\.[0-9]+)?)(ns|us|µs|ms|s|m|h|d|w)`)
+	re_units_duration      = regexp.MustCompile(`^([-+]?)((?:[0-9]+(?:\.[0-9]+)?(?:ns|us|µs|ms|s|m|h|d|w))+)$`)
+	re_units_uptime        = regexp.MustCompile(
+		`^(?:([0-9]+)\s+days?,?\s*)?(?:([0-9]+):([0-9]{2})(?::([0-9]{2}))?|([0-9]+)\s+mins?)?$`)
+)
+
+func units_parse_duration(raw string) (float64, bool) {
+	if m := re_units_duration.FindStringSubmatch(raw); m != nil {
+		secs := float64(0)
+		for _, part := range re_units_duration_part.FindAllStringSubmatch(m[2], -1) {
+			v, err := strconv.ParseFloat(part[1], 64)
+			if err != nil {
+				return 0, false
+			}
+			secs += v * units_durations[part[2]]
+		}
+		if m[1] == "-" {
+			secs = -secs
+		}
+		return secs, true
+	}
+	m := re_units_uptime.FindStringSubmatch(raw)
+	if m == nil || raw == "" {
+		return 0, false
+	}
+	secs := float64(0)
+	for i, mult := range []float64{86400, 3600, 60, 1, 60} {
+		if m[i+1] == "" {
+			continue
+		}
+		v, err := strconv.ParseFloat(m[i+1], 64)
+		if err != nil {
+			return 0, false
+		}
+		secs += v * mult
+	}
+	return secs, true
+}
+
+// units_parse converts the value. With IEC units, also the SI prefixes mean
+// powers of 1024.
+func units_parse(raw, units string) (float64, error) {
+	raw = strings.TrimSpace(raw)
+	if val, err := strconv.ParseFloat(raw, 64); err == nil {
+		return val, nil
+	}
+	if secs, ok := units_parse_duration(raw); ok {
+		return secs, nil
+	}
+	if strings.HasSuffix(raw, "%") {
+		return strconv.ParseFloat(strings.TrimSpace(strings.TrimSuffix(raw, "%")), 64)
+	}
+	if m := re_units_prefixed.FindStringSubmatch(raw); m != nil {
+		val, err := strconv.ParseFloat(m[1], 64)
+		if err != nil {
+			return 0, err
+		}
+		base := 1000.0
+		if m[3] == "i" || units == UNITS_IEC {
+			base = 1024
+		}
+		return val * math.Pow(base, float64(units_prefixes[m[2]])), nil
+	}
+	return 0, fmt.Errorf("unrecognized value: %q", raw)
+}
+
+// metric_parse_value parses the command output of the metric.
+func metric_parse_value(m *metric, raw string) (float64, error) {
+	if m.measure.units == "" {
+		return strconv.ParseFloat(raw, 64)
+	}
+	return units_parse(raw, m.measure.units)
+}